@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dawsonalex/aggregator/server"
+	"github.com/sirupsen/logrus"
+	"thirdlight.com/layered"
+)
+
+// envPrefix starts the names of the environment variables settings
+// can be given in, such as AGGREGATOR_GRPC_PORT for grpc-port.
+const envPrefix = "AGGREGATOR"
+
+// config holds the aggregator's settings.
+type config struct {
+	Port                 uint          `mapstructure:"port"`
+	LogLevel             string        `mapstructure:"log-level"`
+	GRPCPort             uint          `mapstructure:"grpc-port"`
+	ReconcileInterval    time.Duration `mapstructure:"reconcile-interval"`
+	ReconcileConcurrency int           `mapstructure:"reconcile-concurrency"`
+	Nodes                []string      `mapstructure:"nodes"`
+	Subscribe            string        `mapstructure:"subscribe"`
+	NodeTimeout          time.Duration `mapstructure:"node-timeout"`
+	ShutdownTimeout      time.Duration `mapstructure:"shutdown-timeout"`
+	SecretFile           string        `mapstructure:"secret-file"`
+	SignatureWindow      time.Duration `mapstructure:"signature-window"`
+	TLSCert              string        `mapstructure:"tls-cert"`
+	TLSKey               string        `mapstructure:"tls-key"`
+	TLSCA                string        `mapstructure:"tls-ca"`
+	TokensFile           string        `mapstructure:"tokens-file"`
+}
+
+var settings = []layered.Setting{
+	{Key: "port", Flag: "p", Value: uint(defaultPort), Usage: "the port to listen on"},
+	{Key: "log-level", Flag: "log", Value: defaultLogLevel, Usage: "the level of logging (debug, info, warning, fatal, panic)"},
+	{Key: "grpc-port", Value: uint(0), Usage: "the port to serve watcher nodes over gRPC on, 0 to disable"},
+	{Key: "reconcile-interval", Value: defaultReconcileInterval, Usage: "how often each node's file list is fetched to repair drift, 0 to disable"},
+	{Key: "reconcile-concurrency", Value: defaultReconcileConcurrency, Usage: "the most node file lists fetched at once when reconciling"},
+	{Key: "nodes", Flag: "node", Value: []string{}, Usage: "the URL of a watcher node to poll without it saying hello, may be repeated"},
+	{Key: "subscribe", Value: "", Usage: "the URL of this aggregator for nodes given by -node to push their changes to, if they can reach it"},
+	{Key: "node-timeout", Value: defaultNodeTimeout, Usage: "how long to wait for a watcher node to answer a request, 0 for no limit"},
+	{Key: "shutdown-timeout", Value: defaultShutdownTimeout, Usage: "how long to wait for requests in progress to finish when stopping"},
+	{Key: "secret-file", Value: "", Usage: "a file holding the secret watcher nodes sign their requests with; requests are not checked without one"},
+	{Key: "signature-window", Value: server.DefaultSignatureWindow, Usage: "how far from now the time a request was signed may be"},
+	{Key: "tls-cert", Value: "", Usage: "a PEM file holding the certificate to serve HTTPS with, and present to watcher nodes"},
+	{Key: "tls-key", Value: "", Usage: "a PEM file holding the private key of -tls-cert"},
+	{Key: "tls-ca", Value: "", Usage: "a PEM file holding the certificate authorities that sign watcher nodes' certificates, which nodes must then present to say hello, bye or patch files"},
+	{Key: "tokens-file", Value: "", Usage: "a JSON file of the API tokens that may read /files and /duplicates, and their scopes; reads are open to all without one"},
+}
+
+// loadConfig reads the settings into cfg from, in increasing precedence,
+// their defaults, the file given by -config, the environment and the
+// flags in args, defined on flags. It returns true if -print-config
+// was given.
+func loadConfig(flags *flag.FlagSet, args []string, cfg *config) (bool, error) {
+	printConfig, err := layered.Load(flags, args, envPrefix, settings, cfg)
+	if err != nil {
+		return false, err
+	}
+	return printConfig, cfg.validate()
+}
+
+// validate checks the settings are usable together.
+func (c *config) validate() error {
+	if c.Port == 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.GRPCPort > 65535 || c.GRPCPort == c.Port {
+		return fmt.Errorf("invalid grpc-port %d", c.GRPCPort)
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.ReconcileInterval < 0 {
+		return errors.New("reconcile-interval can't be negative")
+	}
+	if c.ReconcileConcurrency < 1 {
+		return errors.New("reconcile-concurrency must be at least 1")
+	}
+	if len(c.Nodes) > 0 && c.ReconcileInterval == 0 {
+		return errors.New("static nodes are polled every reconcile-interval, which must be set")
+	}
+	if c.NodeTimeout < 0 {
+		return errors.New("node-timeout can't be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown-timeout must be positive")
+	}
+	if c.SignatureWindow <= 0 {
+		return errors.New("signature-window must be positive")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if c.TLSCA != "" && c.TLSCert == "" {
+		return errors.New("tls-ca requires tls-cert")
+	}
+	return nil
+}
+
+// print writes the settings as YAML, as they could be given in a file.
+func (c config) print(w io.Writer) error {
+	return layered.Print(w, c)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConfig checks that settings are layered from defaults, a file, the
+// environment and flags, each overriding the last.
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "aggregator.yaml", "port: 9000\nlog-level: debug\ngrpc-port: 9001\nnodes:\n  - http://watcher:4000\n")
+	os.Setenv("AGGREGATOR_LOG_LEVEL", "warn")
+	os.Setenv("AGGREGATOR_NODE_TIMEOUT", "5s")
+	defer os.Unsetenv("AGGREGATOR_LOG_LEVEL")
+	defer os.Unsetenv("AGGREGATOR_NODE_TIMEOUT")
+
+	var cfg config
+	args := []string{"-config", file, "-grpc-port", "9002", "-node", "http://a:4000", "-node", "http://b:4000"}
+	printConfig, err := loadConfig(flag.NewFlagSet("aggregator", flag.ContinueOnError), args, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Error("expected -print-config not to be set")
+	}
+	expected := []struct {
+		setting  string
+		got      interface{}
+		expected interface{}
+	}{
+		{"port from the file", cfg.Port, uint(9000)},
+		{"log-level from the environment", cfg.LogLevel, "warn"},
+		{"grpc-port from a flag", cfg.GRPCPort, uint(9002)},
+		{"nodes from flags", cfg.Nodes, []string{"http://a:4000", "http://b:4000"}},
+		{"node-timeout from the environment", cfg.NodeTimeout, 5 * time.Second},
+		{"reconcile-interval by default", cfg.ReconcileInterval, defaultReconcileInterval},
+	}
+	for _, test := range expected {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.setting, test.expected, test.got)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := cfg.print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "node-timeout: 5s\n") {
+		t.Errorf("expected printed config to hold the node timeout, got:\n%s", out.String())
+	}
+	var printed config
+	if _, err := loadConfig(flag.NewFlagSet("aggregator", flag.ContinueOnError), []string{"-config", writeFile(t, dir, "printed.yaml", out.String())}, &printed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(printed, cfg) {
+		t.Errorf("expected printed config to be read back as\n%+v, got\n%+v", cfg, printed)
+	}
+
+	invalid := [][]string{
+		{"-p", "0"},
+		{"-log", "chatty"},
+		{"-reconcile-concurrency", "0"},
+		{"-reconcile-interval", "0", "-node", "http://a:4000"},
+		{"-tls-cert", "cert.pem"},
+		{"-tls-ca", "ca.pem"},
+		{"-shutdown-timeout", "0"},
+		{"-config", filepath.Join(dir, "missing.yaml")},
+	}
+	for _, args := range invalid {
+		var cfg config
+		if _, err := loadConfig(flag.NewFlagSet("aggregator", flag.ContinueOnError), args, &cfg); err == nil {
+			t.Errorf("expected %v to be refused", args)
+		}
+	}
+}
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -5,6 +5,11 @@ go 1.14
 require (
 	github.com/google/uuid v1.1.1
 	github.com/sirupsen/logrus v1.6.0
-	github.com/spf13/viper v1.7.1
-	google.golang.org/appengine v1.6.6
+	google.golang.org/grpc v1.31.1
+	thirdlight.com/layered v0.0.0
+	thirdlight.com/protocol v0.0.0
 )
+
+replace thirdlight.com/layered => ../layered
+
+replace thirdlight.com/protocol => ../protocol
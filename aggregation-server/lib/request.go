@@ -10,31 +10,25 @@ type FilesResponse struct {
 	Files []string `json:"files"`
 }
 
-// HelloRequest is the type received
-// when a node wishes to register with the aggregator.
-type HelloRequest struct {
-	Instance uuid.UUID `json:"instance"`
-	Port     int       `json:"port"`
-}
-
-// ByeRequest is the type received when a
-// node wishes to unregister with the aggregator.
-type ByeRequest struct {
-	Instance string `json:"instance"`
+// DuplicatesResponse is the type sent when a client requests
+// the files that share content across all nodes.
+type DuplicatesResponse struct {
+	Groups []DuplicateGroup `json:"groups"`
+	Wasted int64            `json:"wasted"`
 }
 
-// File represents a single file with a filename
-type File struct {
-	Filename string `json:"filename"`
+// DuplicateGroup is a set of files with identical content.
+type DuplicateGroup struct {
+	Hash   string          `json:"hash"`
+	Size   int64           `json:"size"`
+	Wasted int64           `json:"wasted"`
+	Files  []DuplicateFile `json:"files"`
 }
 
-// OperationRequest is the message sent from a watcher.
-type OperationRequest struct {
+// DuplicateFile is a file in a duplicate group, along with
+// the node it is held by.
+type DuplicateFile struct {
 	Instance uuid.UUID `json:"instance"`
-	Type     string    `json:"op"`
-	SeqNo    int       `json:"seqno"`
-	Value    File      `json:"value"`
+	Label    string    `json:"label,omitempty"`
+	Filename string    `json:"filename"`
 }
-
-// OperationRequests is a slice of operations.
-type OperationRequests []OperationRequest
@@ -1,62 +1,225 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/dawsonalex/aggregator/watcher"
 
 	"github.com/dawsonalex/aggregator/server"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"thirdlight.com/protocol"
+	"thirdlight.com/protocol/rpc"
 )
 
 const (
-	defaultPort     = 8000
-	defaultLogLevel = "info"
+	defaultPort                 = 8000
+	defaultLogLevel             = "info"
+	defaultReconcileInterval    = time.Minute
+	defaultReconcileConcurrency = 4
+	defaultNodeTimeout          = 30 * time.Second
+	defaultShutdownTimeout      = 10 * time.Second
 )
 
 func main() {
-	var logLevel = flag.String("log", defaultLogLevel, "the level of logging (debug, info, warning, fatal, panic)")
-	var port = flag.Uint("p", defaultPort, "the port to listen on")
-	flag.Parse()
+	var cfg config
+	printConfig, err := loadConfig(flag.CommandLine, os.Args[1:], &cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error in configuration:", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	log := initLogger(*logLevel)
+	log := initLogger(cfg.LogLevel)
 	log.Info("Starting aggregator")
 
+	staticAddresses := make([]*url.URL, 0, len(cfg.Nodes))
+	for _, node := range cfg.Nodes {
+		address, err := staticAddress(node)
+		if err != nil {
+			log.Fatalf("Error parsing node address: %v", err)
+		}
+		staticAddresses = append(staticAddresses, address)
+	}
+
+	// With a shared secret, only signed requests may
+	// change the aggregator's nodes and their files.
+	var verifier *server.Verifier
+	var secret []byte
+	if cfg.SecretFile != "" {
+		secret, err = readSecret(cfg.SecretFile)
+		if err != nil {
+			log.Fatalf("Error reading secret: %v", err)
+		}
+		verifier = server.NewVerifier(secret, cfg.SignatureWindow)
+		log.Info("Requiring requests from nodes to be signed")
+	}
+
+	// With a certificate the aggregator serves HTTPS, and presents it
+	// when fetching nodes' files. With a certificate authority, nodes
+	// must present a certificate it signed to change their files, which
+	// names their instances.
+	requireCert := func(next http.HandlerFunc) http.HandlerFunc { return next }
+	watcher.Client = &http.Client{Timeout: cfg.NodeTimeout}
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" {
+		tlsConfig, err = protocol.ServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		clientConfig, err := protocol.ClientTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		watcher.Client.Transport = &http.Transport{TLSClientConfig: clientConfig}
+		if cfg.TLSCA != "" {
+			requireCert = server.RequireCertificate
+			log.Info("Requiring nodes to present a client certificate")
+		}
+	}
+
+	// With API tokens, each reader sees only the
+	// files of the nodes their token may read.
+	var tokens *server.Tokens
+	if cfg.TokensFile != "" {
+		tokens, err = server.LoadTokens(cfg.TokensFile)
+		if err != nil {
+			log.Fatalf("Error reading tokens: %v", err)
+		}
+		log.Info("Requiring an API token to read files")
+	}
+
 	reg := watcher.NewRegistry(log)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/hello", server.HelloHandler(reg))
-	mux.HandleFunc("/bye", server.ByeHandler(reg))
-	mux.HandleFunc("/files", server.FilesHandler(reg))
+	mux.HandleFunc("/hello", requireCert(verifier.Wrap(server.HelloHandler(reg))))
+	mux.HandleFunc("/bye", requireCert(verifier.Wrap(server.ByeHandler(reg))))
+	mux.HandleFunc("/files", requireCert(verifier.Wrap(tokens.Wrap(server.FilesHandler(reg)))))
+	mux.HandleFunc("/duplicates", tokens.Wrap(server.DuplicatesHandler(reg)))
+	mux.HandleFunc("/debug/vars", tokens.Wrap(expvar.Handler().ServeHTTP))
 
-	addr := fmt.Sprintf(":%d", *port)
-	log.Info("listening on port: ", *port)
+	// Pushed operations can be lost or misapplied, so each node's
+	// file list is also fetched periodically to repair any drift. Static
+	// nodes, which may not be able to reach the aggregator, are polled
+	// in the same way.
+	stopReconcile := make(chan struct{})
+	if cfg.ReconcileInterval > 0 {
+		reconciler := watcher.NewReconciler(reg, cfg.ReconcileInterval, cfg.ReconcileConcurrency)
+		for _, address := range staticAddresses {
+			log.Info("Polling static node at ", address)
+			reconciler.AddStatic(address, cfg.Subscribe, secret)
+		}
+		go reconciler.Run(stopReconcile)
+	}
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	log.Info("listening on port: ", cfg.Port)
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Fatalf("Error starting server: %v", err)
 		}
 	}()
 
+	// Nodes may stream their messages over gRPC instead.
+	var grpcServer *grpc.Server
+	if cfg.GRPCPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
+		if err != nil {
+			log.Fatalf("Error starting gRPC server: %v", err)
+		}
+		var options []grpc.ServerOption
+		if tlsConfig != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer = grpc.NewServer(options...)
+		rpc.RegisterAggregatorServer(grpcServer, server.NewStreamServer(reg, verifier, cfg.TLSCA != ""))
+		log.Info("serving gRPC on port: ", cfg.GRPCPort)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("Error serving gRPC: %v", err)
+			}
+		}()
+	}
+
 	// Wait here until SIGINT received, then exec callback function
 	// to gracefully shutdown.
 	awaitInterrupt(func(done chan bool) {
-		if err := srv.Shutdown(context.Background()); err != nil {
-			panic(err)
+		close(stopReconcile)
+		// Streams stay open for as long as their nodes run,
+		// so they're closed rather than waited for.
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Error stopping server: %v", err)
 		}
 		done <- true
 	})
 	log.Info("Aggregator stopped.")
 }
 
+// staticAddress returns the URL of the files of the watcher node at
+// node, which may be given as the node's base URL.
+func staticAddress(node string) (*url.URL, error) {
+	address, err := url.Parse(node)
+	if err != nil {
+		return nil, err
+	}
+	if (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return nil, fmt.Errorf("%q is not an http URL", node)
+	}
+	if address.Path == "" || address.Path == "/" {
+		address.Path = "/files"
+	}
+	return address, nil
+}
+
+// readSecret returns the secret held in a file, without surrounding
+// whitespace.
+func readSecret(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(contents)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
 func initLogger(logLevel string) *logrus.Logger {
 	log := logrus.New()
 	log.SetFormatter(&logrus.TextFormatter{
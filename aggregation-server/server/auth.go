@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"thirdlight.com/protocol"
+	"thirdlight.com/protocol/rpc"
+)
+
+// DefaultSignatureWindow is how far the time a request was signed may
+// be from the aggregator's clock, by default.
+const DefaultSignatureWindow = protocol.DefaultSignatureWindow
+
+// Verifier checks that the requests of watcher nodes are signed with the
+// secret they share with the aggregator, were signed recently, and
+// haven't been made before.
+type Verifier struct {
+	secret []byte
+	window time.Duration
+	now    func() time.Time
+
+	mux sync.Mutex
+	// seen holds the nonces of requests signed within the window,
+	// with when their signatures fall out of it.
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewVerifier returns a Verifier of requests signed with secret no more
+// than window either side of now.
+func NewVerifier(secret []byte, window time.Duration) *Verifier {
+	return &Verifier{
+		secret: secret,
+		window: window,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Wrap returns a handler that passes signed requests on to next, and
+// refuses those that aren't. GET requests, which only read files, don't
+// need to be signed. A nil Verifier passes every request on.
+func (v *Verifier) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if v == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Errorf("Error reading body: %v", err)
+			http.Error(w, "Error reading body", http.StatusBadRequest)
+			return
+		}
+		signature, err := protocol.SignatureFromHeader(r.Header)
+		if err == nil {
+			err = signature.Verify(v.secret, r.Method, r.URL.Path, body)
+		}
+		if err == nil {
+			err = v.check(signature)
+		}
+		if err != nil {
+			log.WithField("remote", r.RemoteAddr).Warnf("Refusing %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// verifyRequest checks the signature of a request sent on a stream.
+func (v *Verifier) verifyRequest(request *rpc.Request) error {
+	signature, err := request.Verify(v.secret)
+	if err != nil {
+		return err
+	}
+	return v.check(signature)
+}
+
+// check refuses a valid signature made outside the window either side
+// of now, or whose nonce has been seen before.
+func (v *Verifier) check(signature protocol.Signature) error {
+	now := v.now()
+	if err := signature.CheckTime(now, v.window); err != nil {
+		return err
+	}
+	signed := time.Unix(signature.Timestamp, 0)
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	// Nonces are forgotten once their signatures are too
+	// old to be accepted anyway.
+	if now.Sub(v.lastPrune) > v.window/10 {
+		for nonce, expires := range v.seen {
+			if expires.Before(now) {
+				delete(v.seen, nonce)
+			}
+		}
+		v.lastPrune = now
+	}
+	if _, ok := v.seen[signature.Nonce]; ok {
+		return errors.New("request has already been made")
+	}
+	v.seen[signature.Nonce] = signed.Add(v.window)
+	return nil
+}
+
+// RequireCertificate returns a handler that refuses requests made without
+// a verified client certificate, other than GET requests, which are made
+// by people reading files rather than by nodes, and passes the rest on to
+// next.
+func RequireCertificate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && protocol.PeerCertificate(r.TLS) == nil {
+			log.WithField("remote", r.RemoteAddr).Warnf("Refusing %s %s: no client certificate", r.Method, r.URL.Path)
+			http.Error(w, "a verified client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/dawsonalex/aggregator/watcher"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"thirdlight.com/protocol"
+	"thirdlight.com/protocol/rpc"
+)
+
+// StreamServer handles the gRPC streams of watcher nodes, treating each
+// request on a stream as it would the same request made over HTTP.
+type StreamServer struct {
+	reg         *watcher.Registry
+	verifier    *Verifier
+	requireCert bool
+}
+
+// NewStreamServer returns a StreamServer for the nodes in reg. If
+// verifier isn't nil, requests that it doesn't verify are refused. If
+// requireCert is true, streams opened without a verified client
+// certificate are refused.
+func NewStreamServer(reg *watcher.Registry, verifier *Verifier, requireCert bool) *StreamServer {
+	return &StreamServer{reg: reg, verifier: verifier, requireCert: requireCert}
+}
+
+// Sync handles the requests on a node's stream in the order they
+// arrive, acknowledging each, until the node closes the stream.
+func (s *StreamServer) Sync(stream rpc.Aggregator_SyncServer) error {
+	// The node's remote address stands in for that of an
+	// HTTP request, for nodes that don't advertise one, and
+	// its certificate for that of an HTTPS request.
+	remoteAddr := ""
+	var cert *x509.Certificate
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			cert = protocol.PeerCertificate(&info.State)
+		}
+	}
+	if s.requireCert && cert == nil {
+		log.WithField("remote", remoteAddr).Warn("Refusing stream without a client certificate")
+		return status.Error(codes.Unauthenticated, "a verified client certificate is required")
+	}
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(s.handle(remoteAddr, cert, request)); err != nil {
+			log.Errorf("Error acknowledging request: %v", err)
+			return err
+		}
+	}
+}
+
+func (s *StreamServer) handle(remoteAddr string, cert *x509.Certificate, request *rpc.Request) *rpc.Ack {
+	ack := &rpc.Ack{Id: request.Id, Code: http.StatusOK}
+	if s.verifier != nil {
+		if verifyErr := s.verifier.verifyRequest(request); verifyErr != nil {
+			log.WithField("remote", remoteAddr).Warnf("Refusing request on stream: %v", verifyErr)
+			ack.Code = http.StatusUnauthorized
+			ack.Error = verifyErr.Error()
+			return ack
+		}
+	}
+	message, decodeErr := request.Message()
+	if decodeErr != nil {
+		log.Errorf("Invalid request on stream: %v", decodeErr)
+		ack.Code = http.StatusBadRequest
+		ack.Error = fmt.Sprintf("error decoding request: %v", decodeErr)
+		return ack
+	}
+	var err *requestError
+	switch kind := message.Kind.(type) {
+	case *rpc.Message_Hello:
+		err = hello(s.reg, remoteAddr, cert, kind.Hello.Protocol())
+	case *rpc.Message_Bye:
+		err = bye(s.reg, cert, kind.Bye.Protocol())
+	case *rpc.Message_Patch:
+		operations := kind.Patch.Protocol()
+		for _, op := range operations {
+			if validErr := op.Validate(); validErr != nil {
+				log.Errorf("Invalid operations: %v", validErr)
+				err = &requestError{http.StatusBadRequest, validErr.Error()}
+				break
+			}
+		}
+		if err == nil {
+			err = authorizeOperations(cert, operations)
+		}
+		if err == nil {
+			response, status := patch(s.reg, operations)
+			ack.Patch = rpc.NewPatchResponse(response)
+			ack.Code = int32(status)
+		}
+	default:
+		err = &requestError{http.StatusBadRequest, "request carries no hello, patch or bye"}
+	}
+	if err != nil {
+		ack.Code = int32(err.code)
+		ack.Error = err.message
+	}
+	return ack
+}
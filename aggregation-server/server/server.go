@@ -1,16 +1,22 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/dawsonalex/aggregator/lib"
+	"thirdlight.com/protocol"
 
 	"github.com/google/uuid"
 
@@ -34,50 +40,157 @@ func HelloHandler(reg *watcher.Registry) http.HandlerFunc {
 		}
 
 		// unmarshal the request into the expected struct.
-		var node lib.HelloRequest
+		var node protocol.HelloOperation
 		err = json.Unmarshal(body, &node)
 		if err != nil {
 			log.Errorf("Error unmarshalling node: %v", err)
 			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
 			return
 		}
+		if err := hello(reg, r.RemoteAddr, protocol.PeerCertificate(r.TLS), node); err != nil {
+			http.Error(w, err.message, err.code)
+		}
+	})
+}
 
-		// Add the node and set it's initial files if it's new.
-		if fileChan, _, isNew := reg.AddNode(node.Instance); isNew {
-			files := make([]string, 0)
-			url, err := alterAddress(r.RemoteAddr, node.Port)
-			if err == nil {
-				// Request the nodes file list
-				files, err = watcher.GetNodeFiles(url)
-				if err != nil {
-					log.Errorf("error getting files from watcher: %v", err)
-					return
-				}
+// requestError is the reason a request from a node was refused, and
+// the HTTP status it is reported with.
+type requestError struct {
+	code    int
+	message string
+}
 
-				// send the files down the file channel
-				// for the node to add.
-				for _, v := range files {
-					fileChan <- v
-				}
-				close(fileChan)
-			} else {
-				log.Errorf("error parsing url: %v", err)
-				return
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// hello registers the node saying hello from remoteAddr, fetching its
+// files if they're new to the aggregator or have changed unseen. Hellos
+// made with a client certificate that doesn't name the node are refused.
+func hello(reg *watcher.Registry, remoteAddr string, cert *x509.Certificate, node protocol.HelloOperation) *requestError {
+	if err := node.Validate(); err != nil {
+		log.Errorf("Invalid hello: %v", err)
+		return &requestError{http.StatusBadRequest, err.Error()}
+	}
+	if err := protocol.CheckVersion(node.Version); err != nil {
+		log.WithField("ID", node.Instance).Errorf("Rejecting hello: %v", err)
+		return &requestError{http.StatusBadRequest, err.Error()}
+	}
+	nodeID, _ := node.InstanceID()
+	if err := authorize(cert, nodeID); err != nil {
+		return err
+	}
+
+	url, err := nodeAddress(remoteAddr, node)
+	if err != nil {
+		log.Errorf("error parsing url: %v", err)
+		return &requestError{http.StatusBadRequest, "Error parsing address"}
+	}
+
+	// Add the node and set it's initial files if it's new. A known
+	// node that has restarted, or whose sequence is ahead of ours,
+	// has made changes we've missed so its files are fetched again.
+	n, isNew := reg.Register(nodeID)
+	n.SetLabel(node.Label)
+	n.SetAddress(url)
+	n.SetProtocol(node.Version, node.Capabilities)
+	if isNew && node.Negotiated() {
+		log.WithField("ID", node.Instance).Infof("Node speaks protocol version %d with capabilities %v", node.Version, node.Capabilities)
+	}
+	needsResync := isNew
+	if !isNew && node.Epoch > n.Epoch() {
+		log.WithField("ID", node.Instance).Infof("Node restarted in epoch %d, resyncing", node.Epoch)
+		needsResync = true
+	} else if !isNew && node.Sequence > n.Sequence() {
+		log.WithField("ID", node.Instance).Infof("Node is at sequence %d, catching up", node.Sequence)
+		if err := catchUp(n); err != nil {
+			log.Errorf("error getting files from watcher: %v", err)
+		}
+	}
+	if needsResync {
+		if err := resync(n); err != nil {
+			log.Errorf("error getting files from watcher: %v", err)
+		}
+	}
+	return nil
+}
+
+// resync replaces a node's files with those fetched from the node.
+func resync(n *watcher.Node) error {
+	address := n.Address()
+	if address == nil {
+		return fmt.Errorf("no address known for node %s", n.Instance)
+	}
+	listing, err := watcher.GetNodeFiles(address)
+	if err != nil {
+		return err
+	}
+	return n.Resync(listing)
+}
+
+// catchUp applies the changes a node has made since the last operation
+// applied to it, fetching the node's full file list instead if the node
+// no longer holds them or doesn't serve its changes.
+func catchUp(n *watcher.Node) error {
+	address := n.Address()
+	if address == nil {
+		return fmt.Errorf("no address known for node %s", n.Instance)
+	}
+	seqno := n.Sequence()
+	if seqno != watcher.NoSequence && n.Supports(protocol.CapabilityChanges) {
+		changes, err := watcher.GetNodeChanges(address, seqno)
+		if err == nil && changes.Epoch == n.Epoch() {
+			for _, op := range changes.Operations {
+				n.Do(op)
 			}
+			if n.Sequence() >= changes.SeqNo {
+				return nil
+			}
+		} else if err != nil && err != watcher.ErrChangesGone {
+			log.WithField("ID", n.Instance).Warnf("error getting changes from watcher: %v", err)
 		}
-	})
+	}
+	log.WithField("ID", n.Instance).Info("Changes not available, resyncing")
+	return resync(n)
 }
 
-// Take a remote address, format it, set the port, and return a *url.URL
-// that represents the formatted address.
-func alterAddress(remoteAddr string, port int) (*url.URL, error) {
-	host := strings.Split(remoteAddr, ":")[0]
-	newAddr := fmt.Sprintf("http://%s:%d/files", host, port)
-	url, err := url.Parse(newAddr)
+// nodeAddress returns the URL of a node's files. The base URL the node
+// advertises is preferred, falling back to its remote address.
+func nodeAddress(remoteAddr string, hello protocol.HelloOperation) (*url.URL, error) {
+	if hello.Advertise == "" {
+		address, err := alterAddress(remoteAddr, int(hello.Port), hello.Instance)
+		if err == nil && hello.TLS {
+			address.Scheme = "https"
+		}
+		return address, err
+	}
+	base, err := url.Parse(hello.Advertise)
 	if err != nil {
 		return nil, err
 	}
-	return url, nil
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("advertised address %q is not an http URL", hello.Advertise)
+	}
+	base.Path = path.Join("/", base.Path, "files")
+	base.RawQuery = url.Values{"instance": {hello.Instance}}.Encode()
+	return base, nil
+}
+
+// Take a remote address, format it, set the port, and return a *url.URL
+// that represents the formatted address. The instance is passed as a
+// query parameter as a watcher node may serve several directories.
+func alterAddress(remoteAddr string, port int, instance string) (*url.URL, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// The address has no port.
+		host = strings.Trim(remoteAddr, "[]")
+	}
+	return &url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:     "/files",
+		RawQuery: url.Values{"instance": {instance}}.Encode(),
+	}, nil
 }
 
 // ByeHandler handles requests to the /bye endpoint.
@@ -91,66 +204,305 @@ func ByeHandler(reg *watcher.Registry) http.HandlerFunc {
 		defer r.Body.Close()
 		decoder := json.NewDecoder(r.Body)
 
-		var nodeInstance lib.ByeRequest
+		var nodeInstance protocol.ByeOperation
 		err := decoder.Decode(&nodeInstance)
 		if err != nil {
 			log.Error("Error decoding JSON")
 			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
 			return
 		}
-
-		nodeID, err := uuid.Parse(nodeInstance.Instance)
-		if err != nil {
-			log.WithField("value", nodeID).Error("Error parsing node ID")
-			http.Error(w, "Error parsing node ID", http.StatusBadRequest)
-			return
+		if err := bye(reg, protocol.PeerCertificate(r.TLS), nodeInstance); err != nil {
+			http.Error(w, err.message, err.code)
 		}
-		log.WithField("ID", nodeID).Println("Removing node")
-		reg.RemoveNode(nodeID)
 	})
 }
 
+// bye removes a node that has shut down, unless it was made with a client
+// certificate that doesn't name the node.
+func bye(reg *watcher.Registry, cert *x509.Certificate, nodeInstance protocol.ByeOperation) *requestError {
+	nodeID, err := nodeInstance.InstanceID()
+	if err != nil {
+		log.WithField("value", nodeInstance.Instance).Error("Error parsing node ID")
+		return &requestError{http.StatusBadRequest, "Error parsing node ID"}
+	}
+	if err := authorize(cert, nodeID); err != nil {
+		return err
+	}
+	// A bye from an earlier run of a node that has since
+	// restarted mustn't remove the current one.
+	if node := reg.Node(nodeID); node != nil && nodeInstance.Epoch != 0 && nodeInstance.Epoch < node.Epoch() {
+		log.WithField("ID", nodeID).Infof("Ignoring bye from earlier epoch %d", nodeInstance.Epoch)
+		return nil
+	}
+	log.WithField("ID", nodeID).Println("Removing node")
+	reg.RemoveNode(nodeID)
+	return nil
+}
+
 // FilesHandler handles requests to the /files endpoint.
 func FilesHandler(reg *watcher.Registry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
-			// sort and return the filelist
-			files := reg.ListFiles()
+			// sort and return the files the request may read
+			files := reg.ListFilesWhere(readableNodes(r))
 			sort.Strings(files)
 			fileResponse := lib.FilesResponse{
 				Files: files,
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Accept-Patch", protocol.MediaTypeJSONPatch)
 			w.WriteHeader(http.StatusOK)
 			json.NewEncoder(w).Encode(fileResponse)
 
 		} else if r.Method == http.MethodPatch {
 			// Do the file operation
 			defer r.Body.Close()
-			decoder := json.NewDecoder(r.Body)
-
-			var operations lib.OperationRequests
-			err := decoder.Decode(&operations)
+			w.Header().Set("Accept-Patch", protocol.MediaTypeJSONPatch)
+			operations, document, err := decodeOperations(r)
 			if err != nil {
-				log.Errorf("Error decoding JSON: %v", err)
-				http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+				log.Errorf("Invalid operations: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := authorizeOperations(protocol.PeerCertificate(r.TLS), operations); err != nil {
+				http.Error(w, err.message, err.code)
 				return
 			}
 
-			for _, op := range operations {
-				log.WithFields(log.Fields{
-					"ID": op.Instance,
-					"op": op.Type,
-				}).Println("Doing file operation")
-				if node := reg.Node(op.Instance); node != nil {
-					node.Do(watcher.Operation{
-						Type:     op.Type,
-						SeqNo:    op.SeqNo,
-						Filename: op.Value.Filename,
-					})
+			var response protocol.PatchResponse
+			status := http.StatusOK
+			if document {
+				var err *requestError
+				if response, err = patchDocument(reg, operations); err != nil {
+					http.Error(w, err.message, err.code)
+					return
+				}
+			} else {
+				response, status = patch(reg, operations)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(response)
+		}
+	})
+}
+
+// patch carries out operations sent by nodes, returning the outcome of
+// each and the HTTP status to report it with.
+func patch(reg *watcher.Registry, operations []protocol.PatchOperation) (protocol.PatchResponse, int) {
+	response := protocol.PatchResponse{
+		Results: make([]protocol.PatchResult, 0, len(operations)),
+		Nodes:   make([]protocol.NodeSequence, 0),
+	}
+	touched := make(map[uuid.UUID]*watcher.Node)
+	status := http.StatusOK
+	for _, op := range operations {
+		log.WithFields(log.Fields{
+			"ID": op.Instance,
+			"op": op.Op,
+		}).Println("Doing file operation")
+		result := protocol.PatchResult{
+			Instance: op.Instance,
+			Sequence: op.Sequence,
+			Status:   watcher.StatusUnknownNode,
+		}
+		id, _ := op.InstanceID()
+		node := reg.Node(id)
+		if node == nil {
+			// The aggregator has restarted or dropped the node, so
+			// tell it to say hello again and have its files fetched.
+			log.WithField("ID", op.Instance).Warn("Operation for unknown node")
+			status = http.StatusNotFound
+		} else {
+			touched[id] = node
+			// The node has restarted since its files were fetched, so
+			// fetch them again rather than apply its new sequence
+			// numbers to the old state.
+			if op.Epoch > node.Epoch() {
+				log.WithField("ID", op.Instance).Infof("Node restarted in epoch %d, resyncing", op.Epoch)
+				if err := resync(node); err != nil {
+					log.Errorf("error getting files from watcher: %v", err)
+				}
+			}
+			operation := watcher.Operation{
+				Type:      op.Op,
+				Epoch:     op.Epoch,
+				SeqNo:     op.Sequence,
+				PrevSeqNo: op.Previous,
+				Filename:  op.Value.Filename,
+				FileInfo: watcher.FileInfo{
+					Size: op.Value.Size,
+					Hash: op.Value.Hash,
+				},
+			}
+			result.Status = node.Do(operation)
+			// Operations before this one have gone missing, so
+			// fetch them from the node and try again.
+			if result.Status == watcher.StatusOutOfSequence {
+				log.WithField("ID", op.Instance).Infof("Missed operations before %d, catching up", op.Sequence)
+				if err := catchUp(node); err != nil {
+					log.Errorf("error getting changes from watcher: %v", err)
+				} else {
+					result.Status = node.Do(operation)
 				}
 			}
 		}
+		response.Results = append(response.Results, result)
+	}
+	response.Nodes = nodeSequences(touched)
+	return response, status
+}
+
+// patchDocument carries out the operations of a JSON Patch document, all
+// of them or, if any can't be, none, returning the response to give.
+func patchDocument(reg *watcher.Registry, operations []protocol.PatchOperation) (protocol.PatchResponse, *requestError) {
+	response := protocol.PatchResponse{
+		Results: make([]protocol.PatchResult, 0, len(operations)),
+	}
+	touched := make(map[uuid.UUID]*watcher.Node)
+	ops := make([]watcher.NodeOperation, 0, len(operations))
+	for _, op := range operations {
+		id, _ := op.InstanceID()
+		node := reg.Node(id)
+		if node == nil {
+			log.WithField("ID", op.Instance).Warn("JSON Patch for unknown node")
+			return response, &requestError{http.StatusNotFound, fmt.Sprintf("unknown instance %s", op.Instance)}
+		}
+		touched[id] = node
+		response.Results = append(response.Results, protocol.PatchResult{
+			Instance: op.Instance,
+			Sequence: op.Sequence,
+			Status:   watcher.StatusApplied,
+		})
+		ops = append(ops, watcher.NodeOperation{
+			Node: node,
+			Operation: watcher.Operation{
+				Type:      op.Op,
+				Epoch:     op.Epoch,
+				SeqNo:     op.Sequence,
+				PrevSeqNo: op.Previous,
+				Filename:  op.Value.Filename,
+				FileInfo: watcher.FileInfo{
+					Size: op.Value.Size,
+					Hash: op.Value.Hash,
+				},
+			},
+		})
+	}
+	if err := watcher.ApplyPatch(ops); err != nil {
+		log.Errorf("Refusing JSON Patch: %v", err)
+		return response, &requestError{http.StatusConflict, err.Error()}
+	}
+	log.Infof("Applied JSON Patch of %d operations", len(ops))
+	response.Nodes = nodeSequences(touched)
+	return response, nil
+}
+
+// nodeSequences returns the sequence each of the nodes is at.
+func nodeSequences(nodes map[uuid.UUID]*watcher.Node) []protocol.NodeSequence {
+	sequences := make([]protocol.NodeSequence, 0, len(nodes))
+	for id, node := range nodes {
+		sequences = append(sequences, protocol.NodeSequence{
+			BaseMessage: protocol.BaseMessage{Instance: id.String(), Epoch: node.Epoch()},
+			Sequence:    node.Sequence(),
+		})
+	}
+	return sequences
+}
+
+// authorize refuses a request made with a client certificate to change
+// nodes the certificate doesn't name. Requests made without one are
+// refused by RequireCertificate, where certificates are required.
+func authorize(cert *x509.Certificate, ids ...uuid.UUID) *requestError {
+	if cert == nil {
+		return nil
+	}
+	for _, id := range ids {
+		if !protocol.CertifiesInstance(cert, id.String()) {
+			log.WithFields(log.Fields{"ID": id, "identity": cert.Subject.CommonName}).Warn("Refusing request for node the certificate doesn't name")
+			return &requestError{http.StatusForbidden, fmt.Sprintf("certificate doesn't name instance %s", id)}
+		}
+	}
+	return nil
+}
+
+// authorizeOperations refuses operations made with a client certificate
+// if any is for a node the certificate doesn't name.
+func authorizeOperations(cert *x509.Certificate, operations []protocol.PatchOperation) *requestError {
+	ids := make([]uuid.UUID, 0, len(operations))
+	for _, op := range operations {
+		id, _ := op.InstanceID()
+		ids = append(ids, id)
+	}
+	return authorize(cert, ids...)
+}
+
+// decodeOperations reads the operations of a PATCH request, sent either
+// as a JSON Patch document or as watcher nodes send them, returning true
+// if they were sent as a JSON Patch document.
+func decodeOperations(r *http.Request) ([]protocol.PatchOperation, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == protocol.MediaTypeJSONPatch {
+		var patch []protocol.JSONPatchOperation
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return nil, true, fmt.Errorf("error parsing JSON: %v", err)
+		}
+		operations := make([]protocol.PatchOperation, 0, len(patch))
+		for i, op := range patch {
+			operation, err := op.PatchOperation()
+			if err != nil {
+				return nil, true, fmt.Errorf("operation %d: %v", i, err)
+			}
+			operations = append(operations, operation)
+		}
+		return operations, true, nil
+	}
+
+	var operations []protocol.PatchOperation
+	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+		return nil, false, fmt.Errorf("error parsing JSON: %v", err)
+	}
+	for _, op := range operations {
+		if err := op.Validate(); err != nil {
+			return nil, false, err
+		}
+	}
+	return operations, false, nil
+}
+
+// DuplicatesHandler handles requests to the /duplicates endpoint.
+func DuplicatesHandler(reg *watcher.Registry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !(r.Method == http.MethodGet) {
+			log.Errorf("Invalid HTTP method, got: %v", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		response := lib.DuplicatesResponse{
+			Groups: make([]lib.DuplicateGroup, 0),
+		}
+		for _, group := range reg.DuplicatesWhere(readableNodes(r)) {
+			files := make([]lib.DuplicateFile, 0, len(group.Files))
+			for _, file := range group.Files {
+				files = append(files, lib.DuplicateFile{
+					Instance: file.Instance,
+					Label:    file.Label,
+					Filename: file.Filename,
+				})
+			}
+			response.Groups = append(response.Groups, lib.DuplicateGroup{
+				Hash:   group.Hash,
+				Size:   group.Size,
+				Wasted: group.Wasted,
+				Files:  files,
+			})
+			response.Wasted += group.Wasted
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
 	})
 }
 
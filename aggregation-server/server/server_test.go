@@ -0,0 +1,591 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dawsonalex/aggregator/lib"
+	"github.com/dawsonalex/aggregator/watcher"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"thirdlight.com/protocol"
+	"thirdlight.com/protocol/rpc"
+)
+
+func TestNodeAddress(t *testing.T) {
+	id := uuid.MustParse("56d1a8de-14a8-403b-b3e7-d49307c63553")
+	query := "?instance=" + id.String()
+
+	tests := []struct {
+		remoteAddr string
+		advertise  string
+		expected   string
+	}{
+		{"10.0.0.5:53211", "", "http://10.0.0.5:4000/files" + query},
+		{"[2001:db8::1]:53211", "", "http://[2001:db8::1]:4000/files" + query},
+		{"[::1]:53211", "", "http://[::1]:4000/files" + query},
+		{"10.0.0.5:53211", "https://watcher.example.com", "https://watcher.example.com/files" + query},
+		{"10.0.0.5:53211", "http://proxy:8080/watchers/one/", "http://proxy:8080/watchers/one/files" + query},
+		{"10.0.0.5:53211", "http://[2001:db8::2]:4001", "http://[2001:db8::2]:4001/files" + query},
+	}
+	for _, test := range tests {
+		hello := protocol.HelloOperation{BaseMessage: protocol.BaseMessage{Instance: id.String()}, Port: 4000, Advertise: test.advertise}
+		u, err := nodeAddress(test.remoteAddr, hello)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.remoteAddr, test.advertise, err)
+			continue
+		}
+		if u.String() != test.expected {
+			t.Errorf("%s %q: expected %s, got %s", test.remoteAddr, test.advertise, test.expected, u)
+		}
+	}
+
+	hello := protocol.HelloOperation{BaseMessage: protocol.BaseMessage{Instance: id.String()}, Port: 4000, TLS: true}
+	if u, err := nodeAddress("10.0.0.5:53211", hello); err != nil || u.String() != "https://10.0.0.5:4000/files"+query {
+		t.Errorf("expected node serving TLS to be reached over https, got %v %v", u, err)
+	}
+
+	for _, advertise := range []string{"watcher:4000", "ftp://watcher", "http://"} {
+		hello := protocol.HelloOperation{BaseMessage: protocol.BaseMessage{Instance: id.String()}, Port: 4000, Advertise: advertise}
+		if _, err := nodeAddress("10.0.0.5:53211", hello); err == nil {
+			t.Errorf("expected %q to be rejected", advertise)
+		}
+	}
+}
+
+// TestPatchCatchUp checks that operations missed before a patch are
+// fetched from the node's changes rather than its full file list.
+func TestPatchCatchUp(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/changes" || r.URL.Query().Get("since") != "2" {
+			t.Errorf("unexpected request to node: %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		instance := r.URL.Query().Get("instance")
+		fmt.Fprintf(w, `{"instance":%[1]q,"epoch":1,"seqno":4,"changes":[`+
+			`{"instance":%[1]q,"epoch":1,"op":"add","seqno":3,"value":{"filename":"missed.txt"}},`+
+			`{"instance":%[1]q,"epoch":1,"op":"add","seqno":4,"value":{"filename":"sent.txt"}}]}`, instance)
+	}))
+	defer node.Close()
+
+	reg := watcher.NewRegistry(nil)
+	id := uuid.New()
+	n, _ := reg.Register(id)
+	address, _ := url.Parse(node.URL + "/files?instance=" + id.String())
+	n.SetAddress(address)
+	n.Resync(watcher.Listing{Instance: id, Epoch: 1, SeqNo: 2})
+
+	body := fmt.Sprintf(`[{"instance":%q,"epoch":1,"op":"add","seqno":4,"value":{"filename":"sent.txt"}}]`, id)
+	recorder := httptest.NewRecorder()
+	FilesHandler(reg)(recorder, httptest.NewRequest(http.MethodPatch, "/files", strings.NewReader(body)))
+
+	var response protocol.PatchResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 1 || response.Results[0].Status != watcher.StatusDuplicate {
+		t.Errorf("expected operation to have been caught up, got %+v", response.Results)
+	}
+	if n.Sequence() != 4 || len(n.ListFiles()) != 2 {
+		t.Errorf("expected 2 files at sequence 4, got %v at %d", n.ListFiles(), n.Sequence())
+	}
+}
+
+// TestJSONPatch checks that files can be patched with a JSON Patch
+// document, applied all or not at all, and that operations it can't
+// express are rejected.
+func TestJSONPatch(t *testing.T) {
+	reg := watcher.NewRegistry(nil)
+	id, sequenced := uuid.New(), uuid.New()
+	n, _ := reg.Register(id)
+	s, _ := reg.Register(sequenced)
+	s.Resync(watcher.Listing{Instance: sequenced, Epoch: 1, SeqNo: 2, Files: []watcher.File{{Filename: "old.txt"}}})
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPatch, "/files", strings.NewReader(body))
+		request.Header.Set("Content-Type", protocol.MediaTypeJSONPatch)
+		recorder := httptest.NewRecorder()
+		FilesHandler(reg)(recorder, request)
+		return recorder
+	}
+
+	recorder := patch(fmt.Sprintf(`[
+		{"op":"add","path":"/%[1]s/old.txt","value":{"size":1}},
+		{"op":"add","path":"/%[1]s/new.txt","value":{"size":3,"hash":"aa"}},
+		{"op":"replace","path":"/%[1]s/new.txt","value":{"size":4}},
+		{"op":"add","path":"/%[1]s/a~0b.txt","value":{"size":4}},
+		{"op":"remove","path":"/%[1]s/old.txt"}
+	]`, id))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected patch to succeed, got %d %q", recorder.Code, recorder.Body)
+	}
+	files := n.ListFiles()
+	sort.Strings(files)
+	if len(files) != 2 || files[0] != "a~b.txt" || files[1] != "new.txt" || n.Sequence() != watcher.NoSequence {
+		t.Errorf("unexpected files %v at sequence %d", files, n.Sequence())
+	}
+
+	recorder = patch(fmt.Sprintf(`[{"op":"remove","path":"/%s/old.txt","epoch":1,"seqno":3}]`, sequenced))
+	if recorder.Code != http.StatusOK || s.Sequence() != 3 || len(s.ListFiles()) != 0 {
+		t.Errorf("expected sequenced patch to succeed, got %d %q with %v at %d", recorder.Code, recorder.Body, s.ListFiles(), s.Sequence())
+	}
+
+	for _, body := range []string{
+		fmt.Sprintf(`[{"op":"add","path":"/%[1]s/more.txt","value":{"size":1}},{"op":"replace","path":"/%[1]s/missing.txt","value":{"size":1}}]`, id),
+		fmt.Sprintf(`[{"op":"add","path":"/%[1]s/more.txt","value":{"size":1}},{"op":"remove","path":"/%[1]s/more.txt"},{"op":"remove","path":"/%[1]s/more.txt"}]`, id),
+		fmt.Sprintf(`[{"op":"add","path":"/%s/more.txt","value":{"size":1}},{"op":"add","path":"/%s/more.txt","value":{"size":1}}]`, id, sequenced),
+		fmt.Sprintf(`[{"op":"add","path":"/%s/more.txt","value":{"size":1}},{"op":"add","path":"/%s/more.txt","value":{"size":1},"seqno":5}]`, id, sequenced),
+		fmt.Sprintf(`[{"op":"add","path":"/%s/more.txt","value":{"size":1},"epoch":2,"seqno":4}]`, sequenced),
+	} {
+		if recorder := patch(body); recorder.Code != http.StatusConflict {
+			t.Errorf("expected %s to conflict, got %d", body, recorder.Code)
+		}
+	}
+	if len(n.ListFiles()) != 2 || len(s.ListFiles()) != 0 || s.Sequence() != 3 {
+		t.Errorf("expected conflicting patches not to change files, got %v and %v at %d", n.ListFiles(), s.ListFiles(), s.Sequence())
+	}
+
+	if recorder := patch(fmt.Sprintf(`[{"op":"add","path":"/%s/more.txt","value":{"size":1}}]`, uuid.New())); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected patch of unknown node to be not found, got %d", recorder.Code)
+	}
+	for _, body := range []string{
+		fmt.Sprintf(`[{"op":"move","from":"/%[1]s/new.txt","path":"/%[1]s/moved.txt"}]`, id),
+		fmt.Sprintf(`[{"op":"add","path":"/%s/dir/new.txt","value":{"size":3}}]`, id),
+		`[{"op":"remove","path":"/files/new.txt"}]`,
+	} {
+		if recorder := patch(body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, recorder.Code)
+		}
+	}
+	if len(n.ListFiles()) != 2 {
+		t.Errorf("expected rejected patches not to change files, got %v", n.ListFiles())
+	}
+}
+
+// TestHelloProtocol checks that hellos in an unsupported protocol
+// version are rejected, and that a node which doesn't serve its changes
+// has its file list fetched to catch up instead.
+func TestHelloProtocol(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files" {
+			t.Errorf("unexpected request to node: %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"instance":%q,"epoch":1,"seqno":5,"files":[{"filename":"file.txt"}]}`, r.URL.Query().Get("instance"))
+	}))
+	defer node.Close()
+
+	reg := watcher.NewRegistry(nil)
+	id := uuid.New()
+	hello := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		HelloHandler(reg)(recorder, httptest.NewRequest(http.MethodPost, "/hello", strings.NewReader(body)))
+		return recorder
+	}
+
+	recorder := hello(fmt.Sprintf(`{"instance":%q,"epoch":1,"advertise":%q,"version":%d}`, id, node.URL, protocol.Version+1))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "unsupported protocol version") {
+		t.Errorf("expected unsupported version to be rejected, got %d %q", recorder.Code, recorder.Body)
+	}
+	if reg.Node(id) != nil {
+		t.Error("expected node in an unsupported version not to be registered")
+	}
+
+	body := fmt.Sprintf(`{"instance":%q,"epoch":1,"advertise":%q,"version":1,"capabilities":["supports-metadata"]}`, id, node.URL)
+	if recorder := hello(body); recorder.Code != http.StatusOK {
+		t.Fatalf("expected hello to succeed, got %d %q", recorder.Code, recorder.Body)
+	}
+	n := reg.Node(id)
+	n.Resync(watcher.Listing{Instance: id, Epoch: 1, SeqNo: 2})
+
+	body = fmt.Sprintf(`{"instance":%q,"epoch":1,"advertise":%q,"seqno":5,"version":1,"capabilities":["supports-metadata"]}`, id, node.URL)
+	hello(body)
+	if n.Sequence() != 5 || len(n.ListFiles()) != 1 {
+		t.Errorf("expected node to be resynced to sequence 5, got %v at %d", n.ListFiles(), n.Sequence())
+	}
+}
+
+// TestCertificateBinding checks that a node can only be changed with a
+// client certificate naming its instance, and that where certificates are
+// required, nodes can't change files without one but files can be read.
+func TestCertificateBinding(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"instance":%q,"epoch":1,"files":[]}`, r.URL.Query().Get("instance"))
+	}))
+	defer node.Close()
+
+	reg := watcher.NewRegistry(nil)
+	id, other := uuid.New(), uuid.New()
+	certificate := func(ids ...uuid.UUID) *x509.Certificate {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "node"}}
+		for _, id := range ids {
+			uri, _ := url.Parse(protocol.InstanceURI(id.String()))
+			cert.URIs = append(cert.URIs, uri)
+		}
+		return cert
+	}
+	request := func(handler http.HandlerFunc, method, path string, cert *x509.Certificate, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		recorder := httptest.NewRecorder()
+		RequireCertificate(handler)(recorder, r)
+		return recorder.Code
+	}
+	helloBody := fmt.Sprintf(`{"instance":%q,"epoch":1,"advertise":%q}`, id, node.URL)
+	patchBody := fmt.Sprintf(`[{"instance":%q,"epoch":1,"op":"add","value":{"filename":"file.txt"},"seqno":1}]`, id)
+	byeBody := fmt.Sprintf(`{"instance":%q,"epoch":1}`, id)
+
+	if code := request(HelloHandler(reg), http.MethodPost, "/hello", certificate(other), helloBody); code != http.StatusForbidden || reg.Node(id) != nil {
+		t.Fatalf("expected hello with a certificate for another node to be refused, got %d", code)
+	}
+	if code := request(HelloHandler(reg), http.MethodPost, "/hello", certificate(other, id), helloBody); code != http.StatusOK {
+		t.Fatalf("expected hello with a certificate naming the node to succeed, got %d", code)
+	}
+	tests := []struct {
+		scenario string
+		handler  http.HandlerFunc
+		method   string
+		path     string
+		cert     *x509.Certificate
+		body     string
+		code     int
+	}{
+		{"hello without a certificate", HelloHandler(reg), http.MethodPost, "/hello", nil, helloBody, http.StatusUnauthorized},
+		{"patch without a certificate", FilesHandler(reg), http.MethodPatch, "/files", nil, patchBody, http.StatusUnauthorized},
+		{"patch from another node", FilesHandler(reg), http.MethodPatch, "/files", certificate(other), patchBody, http.StatusForbidden},
+		{"bye from another node", ByeHandler(reg), http.MethodPost, "/bye", certificate(other), byeBody, http.StatusForbidden},
+		{"read without a certificate", FilesHandler(reg), http.MethodGet, "/files", nil, "", http.StatusOK},
+		{"patch from the node", FilesHandler(reg), http.MethodPatch, "/files", certificate(id), patchBody, http.StatusOK},
+		{"hello again from the node", HelloHandler(reg), http.MethodPost, "/hello", certificate(id), helloBody, http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := request(test.handler, test.method, test.path, test.cert, test.body); code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.scenario, test.code, code)
+		}
+	}
+	if files := reg.Node(id).ListFiles(); len(files) != 1 {
+		t.Errorf("expected only the node's own patch to be applied, got %v", files)
+	}
+
+	bye := streamRequest(t, 1, rpc.ByeMessage(protocol.ByeOperation{BaseMessage: protocol.BaseMessage{Instance: id.String(), Epoch: 1}}))
+	if ack := NewStreamServer(reg, nil, true).handle("", certificate(other), bye); ack.Code != http.StatusForbidden {
+		t.Errorf("expected bye on stream from another node to be refused, got %+v", ack)
+	}
+	if ack := NewStreamServer(reg, nil, true).handle("", certificate(id), bye); ack.Code != http.StatusOK || reg.Node(id) != nil {
+		t.Errorf("expected bye on stream from the node to remove it, got %+v", ack)
+	}
+}
+
+// TestStream checks that hellos, patches and byes sent on a gRPC
+// stream are handled as they are over HTTP, and each acknowledged.
+func TestStream(t *testing.T) {
+	id := uuid.New()
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"instance":%q,"epoch":1,"seqno":1,"files":[{"filename":"base.txt"}]}`, id)
+	}))
+	defer node.Close()
+
+	reg := watcher.NewRegistry(nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	rpc.RegisterAggregatorServer(srv, NewStreamServer(reg, nil, false))
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := rpc.NewAggregatorClient(conn).Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := protocol.BaseMessage{Instance: id.String(), Epoch: 1}
+	requests := []*rpc.Request{
+		streamRequest(t, 1, rpc.HelloMessage(protocol.HelloOperation{BaseMessage: base, Advertise: node.URL, Version: protocol.Version})),
+		streamRequest(t, 2, rpc.PatchMessage([]protocol.PatchOperation{
+			{BaseMessage: base, Op: protocol.OpAdd, Value: protocol.FileMetadata{Filename: "new.txt"}, Sequence: 2},
+		})),
+		streamRequest(t, 3, rpc.PatchMessage([]protocol.PatchOperation{
+			{BaseMessage: protocol.BaseMessage{Instance: uuid.New().String()}, Op: protocol.OpAdd, Value: protocol.FileMetadata{Filename: "lost.txt"}, Sequence: 1},
+		})),
+		streamRequest(t, 4, rpc.HelloMessage(protocol.HelloOperation{BaseMessage: base, Port: 4000, Version: protocol.Version + 1})),
+		{Id: 5, Body: []byte("not a bye")},
+		streamRequest(t, 6, &rpc.Message{}),
+	}
+	codes := []int{http.StatusOK, http.StatusOK, http.StatusNotFound, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest}
+	for i, request := range requests {
+		if err := stream.Send(request); err != nil {
+			t.Fatal(err)
+		}
+		ack, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack.Id != request.Id || int(ack.Code) != codes[i] {
+			t.Errorf("request %d: expected code %d, got %+v", request.Id, codes[i], ack)
+		}
+		if message, _ := request.Message(); message.GetPatch() != nil && len(ack.Patch.Protocol().Results) != 1 {
+			t.Errorf("request %d: expected a result for the operation, got %+v", request.Id, ack.Patch)
+		}
+	}
+	if n := reg.Node(id); n == nil || n.Sequence() != 2 || len(n.ListFiles()) != 2 {
+		t.Fatal("expected node to have been registered and patched")
+	}
+
+	if err := stream.Send(streamRequest(t, 7, rpc.ByeMessage(protocol.ByeOperation{BaseMessage: base}))); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := stream.Recv(); err != nil || ack.Code != http.StatusOK {
+		t.Fatalf("expected bye to be acknowledged, got %+v %v", ack, err)
+	}
+	if reg.Node(id) != nil {
+		t.Error("expected node to have been removed")
+	}
+}
+
+// streamRequest returns a request to send on a stream carrying message.
+func streamRequest(t *testing.T, id uint64, message *rpc.Message) *rpc.Request {
+	request, err := rpc.NewRequest(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Id = id
+	return request
+}
+
+// TestVerifier checks that only requests signed recently with the
+// shared secret are passed on, and only once.
+func TestVerifier(t *testing.T) {
+	secret := []byte("secret")
+	verifier := NewVerifier(secret, time.Minute)
+	now := time.Unix(1600000000, 0)
+	verifier.now = func() time.Time { return now }
+
+	handled := 0
+	handler := verifier.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == http.MethodPost && string(body) != `{"instance":"a"}` {
+			t.Errorf("expected body to be passed on, got %q", body)
+		}
+		handled++
+	})
+	request := func(secret []byte, signedAt time.Time) *http.Request {
+		body := `{"instance":"a"}`
+		r := httptest.NewRequest(http.MethodPost, "/bye", strings.NewReader(body))
+		signature, err := protocol.Sign(secret, http.MethodPost, "/bye", []byte(body), signedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature.SetHeader(r.Header)
+		return r
+	}
+
+	signed := request(secret, now.Add(-30*time.Second))
+	replayed := request(secret, now)
+	replayed.Header = signed.Header
+	tests := []struct {
+		scenario string
+		request  *http.Request
+		code     int
+	}{
+		{"signed", signed, http.StatusOK},
+		{"replayed", replayed, http.StatusUnauthorized},
+		{"unsigned", httptest.NewRequest(http.MethodPost, "/bye", strings.NewReader(`{"instance":"a"}`)), http.StatusUnauthorized},
+		{"wrong secret", request([]byte("guess"), now), http.StatusUnauthorized},
+		{"too old", request(secret, now.Add(-2*time.Minute)), http.StatusUnauthorized},
+		{"read", httptest.NewRequest(http.MethodGet, "/files", nil), http.StatusOK},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler(recorder, test.request)
+		if recorder.Code != test.code {
+			t.Errorf("%s: expected %d, got %d %q", test.scenario, test.code, recorder.Code, recorder.Body)
+		}
+	}
+	if handled != 2 {
+		t.Errorf("expected 2 requests to be handled, got %d", handled)
+	}
+
+	stream := streamRequest(t, 1, rpc.ByeMessage(protocol.ByeOperation{BaseMessage: protocol.BaseMessage{Instance: uuid.New().String()}}))
+	if ack := NewStreamServer(watcher.NewRegistry(nil), verifier, false).handle("", nil, stream); ack.Code != http.StatusUnauthorized {
+		t.Errorf("expected unsigned request on stream to be refused, got %+v", ack)
+	}
+	if err := stream.Sign(secret, now); err != nil {
+		t.Fatal(err)
+	}
+	tampered := streamRequest(t, 1, rpc.HelloMessage(protocol.HelloOperation{BaseMessage: protocol.BaseMessage{Instance: uuid.New().String()}, Port: 4000}))
+	tampered.Signature = stream.Signature
+	if ack := NewStreamServer(watcher.NewRegistry(nil), verifier, false).handle("", nil, tampered); ack.Code != http.StatusUnauthorized {
+		t.Errorf("expected request on stream with another body than signed to be refused, got %+v", ack)
+	}
+	if ack := NewStreamServer(watcher.NewRegistry(nil), verifier, false).handle("", nil, stream); ack.Code != http.StatusOK {
+		t.Errorf("expected signed request on stream to be handled, got %+v", ack)
+	}
+}
+
+// TestTokens checks that reads need an API token, and show only the
+// files of the nodes the token may read.
+func TestTokens(t *testing.T) {
+	reg := watcher.NewRegistry(nil)
+	docs, photos := uuid.New(), uuid.New()
+	for id, label := range map[uuid.UUID]string{docs: "docs", photos: "photos"} {
+		n, _ := reg.Register(id)
+		n.SetLabel(label)
+		n.Resync(watcher.Listing{Instance: id, Epoch: 1, SeqNo: 1, Files: []watcher.File{
+			{Filename: label + ".txt", FileInfo: watcher.FileInfo{Size: 10, Hash: "same"}},
+		}})
+	}
+
+	tokens, err := NewTokens([]Token{
+		{Name: "admin", Token: "all-token", Scopes: []string{ScopeReadAll}},
+		{Name: "docs team", Token: "docs-token", Scopes: []string{ScopeReadNodePrefix + docs.String()}},
+		{Name: "photos team", Token: "photos-token", Scopes: []string{ScopeReadLabelPrefix + "photos"}},
+		{Name: "nobody", Token: "no-scopes"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(handler http.HandlerFunc, path, auth string, response interface{}) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		recorder := httptest.NewRecorder()
+		tokens.Wrap(handler)(recorder, r)
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code
+	}
+
+	tests := []struct {
+		token      string
+		files      []string
+		duplicates int
+	}{
+		{"all-token", []string{"docs.txt", "photos.txt"}, 1},
+		{"docs-token", []string{"docs.txt"}, 0},
+		{"photos-token", []string{"photos.txt"}, 0},
+		{"no-scopes", []string{}, 0},
+	}
+	for _, test := range tests {
+		var files lib.FilesResponse
+		if code := get(FilesHandler(reg), "/files", "Bearer "+test.token, &files); code != http.StatusOK {
+			t.Fatalf("%s: expected files to be listed, got %d", test.token, code)
+		}
+		if fmt.Sprint(files.Files) != fmt.Sprint(test.files) {
+			t.Errorf("%s: expected files %v, got %v", test.token, test.files, files.Files)
+		}
+		var duplicates lib.DuplicatesResponse
+		if code := get(DuplicatesHandler(reg), "/duplicates", "Bearer "+test.token, &duplicates); code != http.StatusOK {
+			t.Fatalf("%s: expected duplicates to be listed, got %d", test.token, code)
+		}
+		if len(duplicates.Groups) != test.duplicates {
+			t.Errorf("%s: expected %d duplicate groups, got %+v", test.token, test.duplicates, duplicates.Groups)
+		}
+	}
+
+	for _, auth := range []string{"", "Bearer wrong-token", "all-token", "Bearer "} {
+		if code := get(FilesHandler(reg), "/files", auth, nil); code != http.StatusUnauthorized {
+			t.Errorf("%q: expected read to be refused, got %d", auth, code)
+		}
+	}
+
+	// Nodes patch their files without a token.
+	body := fmt.Sprintf(`[{"instance":%q,"epoch":1,"op":"add","value":{"filename":"new.txt"},"seqno":2}]`, docs)
+	recorder := httptest.NewRecorder()
+	tokens.Wrap(FilesHandler(reg))(recorder, httptest.NewRequest(http.MethodPatch, "/files", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected patch without a token to be handled, got %d %q", recorder.Code, recorder.Body)
+	}
+
+	invalid := [][]Token{
+		{{Name: "empty"}},
+		{{Name: "one", Token: "same"}, {Name: "two", Token: "same"}},
+		{{Name: "unknown", Token: "a", Scopes: []string{"write:all"}}},
+		{{Name: "bad node", Token: "a", Scopes: []string{ScopeReadNodePrefix + "docs"}}},
+		{{Name: "no label", Token: "a", Scopes: []string{ScopeReadLabelPrefix}}},
+	}
+	for _, test := range invalid {
+		if _, err := NewTokens(test); err == nil {
+			t.Errorf("expected tokens %+v to be refused", test)
+		}
+	}
+}
+
+// TestConcurrentRequests sends hellos, patches, byes and reads for
+// several nodes at once, to be run with the race detector.
+func TestConcurrentRequests(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files":
+			fmt.Fprintf(w, `{"instance":%q,"epoch":1,"seqno":0,"files":[{"filename":"base.txt","size":1,"hash":"aa"}]}`, r.URL.Query().Get("instance"))
+		default:
+			http.Error(w, "changes no longer held", http.StatusGone)
+		}
+	}))
+	defer node.Close()
+
+	reg := watcher.NewRegistry(nil)
+	handlers := map[string]http.HandlerFunc{
+		"/hello":      HelloHandler(reg),
+		"/bye":        ByeHandler(reg),
+		"/files":      FilesHandler(reg),
+		"/duplicates": DuplicatesHandler(reg),
+	}
+	request := func(method, path, body string) {
+		recorder := httptest.NewRecorder()
+		handlers[path](recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := uuid.New()
+			for i := 1; i <= 50; i++ {
+				switch {
+				case i%10 == 0:
+					request(http.MethodPost, "/bye", fmt.Sprintf(`{"instance":%q,"epoch":1}`, id))
+				case i%10 == 1:
+					request(http.MethodPost, "/hello", fmt.Sprintf(`{"instance":%q,"epoch":1,"port":1,"advertise":%q}`, id, node.URL))
+				case i%3 == 0:
+					request(http.MethodGet, "/files", "")
+					request(http.MethodGet, "/duplicates", "")
+				default:
+					request(http.MethodPatch, "/files", fmt.Sprintf(
+						`[{"instance":%q,"epoch":1,"op":"add","seqno":%d,"value":{"filename":"file-%d.txt","size":1,"hash":"aa"}}]`,
+						id, i, i))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dawsonalex/aggregator/watcher"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// The scopes an API token may be granted. A token may read the files of
+// every node, of a node by instance ID, or of the nodes with a label.
+const (
+	ScopeReadAll         = "read:all"
+	ScopeReadNodePrefix  = "read:node:"
+	ScopeReadLabelPrefix = "read:label:"
+)
+
+// Token is an API token as configured in a tokens file.
+type Token struct {
+	// Name identifies the token's holder in logs.
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// Tokens holds the API tokens that may read the aggregated files.
+type Tokens struct {
+	// grants are keyed by the SHA-256 of each token, so that
+	// looking one up doesn't compare tokens byte by byte.
+	grants map[[sha256.Size]byte]*grant
+}
+
+// grant is what a token may read.
+type grant struct {
+	name   string
+	all    bool
+	nodes  map[uuid.UUID]bool
+	labels map[string]bool
+}
+
+// canRead returns true if the holder of the grant may read a node's files.
+func (g *grant) canRead(n *watcher.Node) bool {
+	return g.all || g.nodes[n.Instance] || g.labels[n.Label()]
+}
+
+// LoadTokens reads API tokens from a JSON file holding a list of Token.
+func LoadTokens(path string) (*Tokens, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return NewTokens(tokens)
+}
+
+// NewTokens returns Tokens granting each token its scopes.
+func NewTokens(tokens []Token) (*Tokens, error) {
+	t := &Tokens{grants: make(map[[sha256.Size]byte]*grant, len(tokens))}
+	for _, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %q is empty", token.Name)
+		}
+		key := sha256.Sum256([]byte(token.Token))
+		if _, ok := t.grants[key]; ok {
+			return nil, fmt.Errorf("token %q is given more than once", token.Name)
+		}
+		g := &grant{
+			name:   token.Name,
+			nodes:  make(map[uuid.UUID]bool),
+			labels: make(map[string]bool),
+		}
+		for _, scope := range token.Scopes {
+			switch {
+			case scope == ScopeReadAll:
+				g.all = true
+			case strings.HasPrefix(scope, ScopeReadNodePrefix):
+				id, err := uuid.Parse(strings.TrimPrefix(scope, ScopeReadNodePrefix))
+				if err != nil {
+					return nil, fmt.Errorf("token %q has invalid scope %q: %v", token.Name, scope, err)
+				}
+				g.nodes[id] = true
+			case strings.HasPrefix(scope, ScopeReadLabelPrefix):
+				if scope == ScopeReadLabelPrefix {
+					return nil, fmt.Errorf("token %q has invalid scope %q: no label", token.Name, scope)
+				}
+				g.labels[strings.TrimPrefix(scope, ScopeReadLabelPrefix)] = true
+			default:
+				return nil, fmt.Errorf("token %q has unknown scope %q", token.Name, scope)
+			}
+		}
+		t.grants[key] = g
+	}
+	return t, nil
+}
+
+// grantKey is the context key of the grant of the token a request
+// was made with.
+type grantKey struct{}
+
+// Wrap returns a handler that passes GET requests made with a known
+// token on to next, which sees only the files of the nodes the token may
+// read, and refuses those without one. Other requests, made by nodes
+// rather than people, are passed on as they are. Nil Tokens pass every
+// request on.
+func (t *Tokens) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next(w, r)
+			return
+		}
+		var g *grant
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			g = t.grants[sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))]
+		}
+		if g == nil {
+			log.WithField("remote", r.RemoteAddr).Warnf("Refusing %s %s: no valid token", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aggregator"`)
+			http.Error(w, "a valid API token is required", http.StatusUnauthorized)
+			return
+		}
+		log.WithField("token", g.name).Debugf("%s %s", r.Method, r.URL.Path)
+		next(w, r.WithContext(context.WithValue(r.Context(), grantKey{}, g)))
+	}
+}
+
+// readableNodes returns a function reporting whether the token a request
+// was made with may read a node's files, or nil if the request wasn't
+// made with a token and may read every node's.
+func readableNodes(r *http.Request) func(*watcher.Node) bool {
+	g, ok := r.Context().Value(grantKey{}).(*grant)
+	if !ok {
+		return nil
+	}
+	return g.canRead
+}
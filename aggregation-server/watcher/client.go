@@ -1,47 +1,178 @@
 package watcher
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"thirdlight.com/protocol"
 )
 
+// Listing is a watcher node's file list, as of a
+// sequence number within one of its epochs.
+type Listing struct {
+	Instance uuid.UUID
+	Label    string
+	Files    []File
+	Epoch    int
+	SeqNo    int
+}
+
+// Client makes the aggregator's requests to watcher nodes. It may be
+// replaced to present a client certificate to nodes serving TLS.
+var Client = &http.Client{}
+
 // GetNodeFiles makes a request to a watcher node for
 // its file list.
-func GetNodeFiles(url *url.URL) ([]string, error) {
+func GetNodeFiles(url *url.URL) (Listing, error) {
 	req, err := http.NewRequest(
 		http.MethodGet,
 		url.String(),
 		nil,
 	)
 	if err != nil {
-		return nil, err
+		return Listing{}, err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := Client.Do(req)
 	if err != nil {
-		return nil, err
+		return Listing{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Listing{}, fmt.Errorf("fetching files from node: %s", resp.Status)
+	}
 	filesBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Listing{}, err
+	}
 
-	fileResponse := struct {
-		Files []struct {
-			Filename string
-		}
-	}{}
+	var fileResponse protocol.ListResponse
 	err = json.Unmarshal(filesBody, &fileResponse)
 	if err != nil {
-		return nil, errors.New("error reading node response")
+		return Listing{}, errors.New("error reading node response")
 	}
+	if err := fileResponse.Validate(); err != nil {
+		return Listing{}, fmt.Errorf("invalid node response: %v", err)
+	}
+	instance, _ := fileResponse.InstanceID()
 
-	files := make([]string, 0)
+	files := make([]File, 0)
 
 	for _, file := range fileResponse.Files {
-		files = append(files, file.Filename)
+		files = append(files, File{
+			Filename: file.Filename,
+			FileInfo: FileInfo{Size: file.Size, Hash: file.Hash},
+		})
+	}
+	return Listing{
+		Instance: instance,
+		Label:    fileResponse.Label,
+		Files:    files,
+		Epoch:    fileResponse.Epoch,
+		SeqNo:    fileResponse.Sequence,
+	}, nil
+}
+
+// ErrChangesGone is returned when a watcher node no longer
+// holds the changes asked for.
+var ErrChangesGone = errors.New("node no longer holds the changes")
+
+// Changes are the operations a watcher node has made since a
+// sequence number, bringing it up to SeqNo.
+type Changes struct {
+	Epoch      int
+	SeqNo      int
+	Operations []Operation
+}
+
+// GetNodeChanges makes a request to the watcher node whose files are
+// at url for the changes it has made since seqno.
+func GetNodeChanges(url *url.URL, seqno int) (Changes, error) {
+	changesURL := *url
+	changesURL.Path = path.Join(path.Dir(url.Path), "changes")
+	query := changesURL.Query()
+	query.Set("since", strconv.Itoa(seqno))
+	changesURL.RawQuery = query.Encode()
+
+	resp, err := Client.Get(changesURL.String())
+	if err != nil {
+		return Changes{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return Changes{}, ErrChangesGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Changes{}, fmt.Errorf("fetching changes from node: %s", resp.Status)
+	}
+
+	var changesResponse protocol.ChangesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&changesResponse); err != nil {
+		return Changes{}, errors.New("error reading node response")
+	}
+	if err := changesResponse.Validate(); err != nil {
+		return Changes{}, fmt.Errorf("invalid node response: %v", err)
+	}
+
+	operations := make([]Operation, 0, len(changesResponse.Operations))
+	for _, change := range changesResponse.Operations {
+		operations = append(operations, Operation{
+			Type:      change.Op,
+			Epoch:     changesResponse.Epoch,
+			SeqNo:     change.Sequence,
+			PrevSeqNo: change.Previous,
+			Filename:  change.Value.Filename,
+			FileInfo:  FileInfo{Size: change.Value.Size, Hash: change.Value.Hash},
+		})
+	}
+	return Changes{
+		Epoch:      changesResponse.Epoch,
+		SeqNo:      changesResponse.Sequence,
+		Operations: operations,
+	}, nil
+}
+
+// Subscribe asks the watcher node serving the files at url to push
+// its changes to the aggregator at aggregator. The request is signed with
+// secret unless it is nil, in which case the node must be reached over
+// TLS with the aggregator's client certificate.
+func Subscribe(url *url.URL, aggregator string, secret []byte) error {
+	subscribeURL := *url
+	subscribeURL.Path = path.Join(path.Dir(url.Path), "subscribe")
+	subscribeURL.RawQuery = ""
+	body, err := json.Marshal(protocol.SubscribeRequest{Aggregator: aggregator})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, subscribeURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != nil {
+		signature, err := protocol.Sign(secret, req.Method, subscribeURL.Path, body, time.Now())
+		if err != nil {
+			return err
+		}
+		signature.SetHeader(req.Header)
+	}
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscribing to node: %s", resp.Status)
 	}
-	return files, nil
+	return nil
 }
@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+	"thirdlight.com/protocol"
+)
+
+type (
+	// NodeFile identifies a file held by a particular node.
+	NodeFile struct {
+		Instance uuid.UUID
+		Label    string
+		Filename string
+	}
+
+	// DuplicateGroup is a set of files across all nodes that
+	// share the same content hash.
+	DuplicateGroup struct {
+		Hash   string
+		Size   int64
+		Wasted int64
+		Files  []NodeFile
+	}
+)
+
+// Duplicates groups the files of all registered nodes by content
+// hash, returning only the groups with more than one file. Groups are
+// ordered by wasted bytes, largest first.
+func (r *Registry) Duplicates() []DuplicateGroup {
+	return r.DuplicatesWhere(nil)
+}
+
+// DuplicatesWhere groups the files of the registered nodes that match
+// returns true for, or of all of them if match is nil, as Duplicates does.
+func (r *Registry) DuplicatesWhere(match func(*Node) bool) []DuplicateGroup {
+	byHash := make(map[string]*DuplicateGroup)
+
+	for _, node := range r.Nodes() {
+		if match != nil && !match(node) {
+			continue
+		}
+		// Without metadata a node's files have no hashes to compare.
+		if !node.Supports(protocol.CapabilityMetadata) {
+			continue
+		}
+		id, label := node.Instance, node.Label()
+		for _, file := range node.Files() {
+			if file.Hash == "" {
+				continue
+			}
+			group, ok := byHash[file.Hash]
+			if !ok {
+				group = &DuplicateGroup{Hash: file.Hash, Size: file.Size}
+				byHash[file.Hash] = group
+			}
+			group.Files = append(group.Files, NodeFile{Instance: id, Label: label, Filename: file.Filename})
+		}
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	for _, group := range byHash {
+		if len(group.Files) < 2 {
+			continue
+		}
+		// Every copy beyond the first is redundant.
+		group.Wasted = group.Size * int64(len(group.Files)-1)
+		sort.Slice(group.Files, func(i, j int) bool {
+			if group.Files[i].Filename != group.Files[j].Filename {
+				return group.Files[i].Filename < group.Files[j].Filename
+			}
+			return group.Files[i].Instance.String() < group.Files[j].Instance.String()
+		})
+		groups = append(groups, *group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted {
+			return groups[i].Wasted > groups[j].Wasted
+		}
+		return groups[i].Hash < groups[j].Hash
+	})
+	return groups
+}
@@ -1,6 +1,8 @@
 package watcher
 
 import (
+	"fmt"
+	"net/url"
 	"sync"
 
 	"github.com/google/uuid"
@@ -9,38 +11,238 @@ import (
 type (
 	// Node represents a watcher-node.
 	// watcher-nodes send file operations to the server.
+	// All of a node's state but its Instance, which never
+	// changes, is guarded by mux.
 	Node struct {
 		Instance uuid.UUID
+		label    string
+		address  *url.URL
+		epoch    int
 		seqno    int
-		files    map[string]struct{}
-		mux      sync.RWMutex
+		files    map[string]FileInfo
+		// version and capabilities are those the node reported in
+		// its hello. capabilities is nil until a node reports them.
+		version      int
+		capabilities map[string]bool
+		mux          sync.RWMutex
+	}
+
+	// FileInfo is the metadata a node reports for one of its files.
+	FileInfo struct {
+		Size int64
+		Hash string
+	}
+
+	// File is a named file as listed by a watcher node.
+	File struct {
+		Filename string
+		FileInfo
 	}
 
 	// Operation represents an operation that a node can
 	// make on a file.
 	Operation struct {
-		Type     string
-		SeqNo    int
-		Filename string
+		Type string
+		// Epoch is the run of the node the operation was made in,
+		// or zero if the node doesn't report epochs.
+		Epoch int
+		SeqNo int
+		// PrevSeqNo is the sequence number the operation follows, if
+		// the node dropped operations in between. Zero means SeqNo-1.
+		PrevSeqNo int
+		Filename  string
+		FileInfo
 	}
 )
 
-// Do tells a node to send an operation down its operation channel.
-func (n *Node) Do(op Operation) {
+// Do tells a node to carry out an operation, returning the outcome
+// as one of the Status values.
+func (n *Node) Do(op Operation) string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	// Operations from an earlier run of the node have been
+	// superseded by the files fetched when it restarted.
+	if op.Epoch != 0 && op.Epoch < n.epoch {
+		return StatusStaleEpoch
+	}
 	// Only carry out the operation if it's the next in sequence, or sequence hasn't
 	// been set yet.
-	if n.seqno == NoSequence || op.SeqNo == n.seqno+1 {
-		n.seqno = op.SeqNo
-
-		switch op.Type {
-		case addOperation:
-			n.mux.Lock()
-			n.files[op.Filename] = struct{}{}
-			n.mux.Unlock()
-		case removeOperation:
-			delete(n.files, op.Filename)
+	if n.seqno != NoSequence && op.follows() != n.seqno {
+		if op.SeqNo <= n.seqno {
+			return StatusDuplicate
+		}
+		return StatusOutOfSequence
+	}
+	n.seqno = op.SeqNo
+	n.apply(op)
+	return StatusApplied
+}
+
+// apply makes the change an operation describes to the node's files.
+// The caller must hold the node's lock.
+func (n *Node) apply(op Operation) {
+	switch op.Type {
+	case addOperation, modifyOperation:
+		n.files[op.Filename] = op.FileInfo
+	case removeOperation:
+		delete(n.files, op.Filename)
+	}
+}
+
+// Label returns the name the node gave to the directory it watches.
+func (n *Node) Label() string {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.label
+}
+
+// SetLabel sets the name of the directory the node watches.
+func (n *Node) SetLabel(label string) {
+	n.mux.Lock()
+	n.label = label
+	n.mux.Unlock()
+}
+
+// SetProtocol records the protocol version and capabilities the node
+// reported in its hello. A version of zero is from a node that predates
+// them, which is assumed to support everything until a request fails.
+func (n *Node) SetProtocol(version int, capabilities []string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.version = version
+	if version == 0 {
+		n.capabilities = nil
+		return
+	}
+	n.capabilities = make(map[string]bool, len(capabilities))
+	for _, capability := range capabilities {
+		n.capabilities[capability] = true
+	}
+}
+
+// Version returns the protocol version the node reported, or zero if
+// it hasn't.
+func (n *Node) Version() int {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.version
+}
+
+// Supports returns true if the node supports a capability, or
+// hasn't reported what it supports.
+func (n *Node) Supports(capability string) bool {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.capabilities == nil || n.capabilities[capability]
+}
+
+// follows returns the sequence number the operation comes after.
+func (op Operation) follows() int {
+	if op.PrevSeqNo != 0 {
+		return op.PrevSeqNo
+	}
+	return op.SeqNo - 1
+}
+
+// Address returns the URL the node's file list is fetched from,
+// or nil if it isn't known.
+func (n *Node) Address() *url.URL {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.address
+}
+
+// SetAddress sets the URL the node's file list is fetched from.
+func (n *Node) SetAddress(address *url.URL) {
+	n.mux.Lock()
+	n.address = address
+	n.mux.Unlock()
+}
+
+// Epoch returns the run of the node its files were last fetched
+// from, or zero if the node doesn't report epochs.
+func (n *Node) Epoch() int {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.epoch
+}
+
+// Sequence returns the sequence number of the last operation
+// applied to the node.
+func (n *Node) Sequence() int {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.seqno
+}
+
+// Resync replaces the node's files, epoch and sequence number
+// with a listing fetched from the node. It returns an error, and
+// leaves the node alone, if the listing is of another instance.
+func (n *Node) Resync(listing Listing) error {
+	if err := n.checkInstance(listing); err != nil {
+		return err
+	}
+	fileMap := make(map[string]FileInfo, len(listing.Files))
+	for _, file := range listing.Files {
+		fileMap[file.Filename] = file.FileInfo
+	}
+	n.mux.Lock()
+	n.files = fileMap
+	n.epoch = listing.Epoch
+	n.seqno = listing.SeqNo
+	n.mux.Unlock()
+	return nil
+}
+
+// Reconcile compares the node's files with a listing fetched from the
+// node and, where they differ, replaces them with the listing. It
+// returns the number of files that differed. Differences are only
+// counted when the listing is at the sequence number already applied,
+// as a later listing differs by the changes still on their way. A
+// listing older than the operations already applied is ignored, as it
+// predates them, and one of another instance is refused.
+func (n *Node) Reconcile(listing Listing) (int, error) {
+	if err := n.checkInstance(listing); err != nil {
+		return 0, err
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if listing.Epoch < n.epoch || (listing.Epoch == n.epoch && listing.SeqNo < n.seqno) {
+		return 0, nil
+	}
+
+	fileMap := make(map[string]FileInfo, len(listing.Files))
+	for _, file := range listing.Files {
+		fileMap[file.Filename] = file.FileInfo
+	}
+	differences := 0
+	if listing.Epoch == n.epoch && listing.SeqNo == n.seqno {
+		for name, info := range n.files {
+			if listed, ok := fileMap[name]; !ok || listed != info {
+				differences++
+			}
+		}
+		for name := range fileMap {
+			if _, ok := n.files[name]; !ok {
+				differences++
+			}
 		}
 	}
+
+	n.files = fileMap
+	n.epoch = listing.Epoch
+	n.seqno = listing.SeqNo
+	return differences, nil
+}
+
+// checkInstance returns an error if a listing is of another instance
+// than the node, as when the address it was fetched from is now served
+// by another node.
+func (n *Node) checkInstance(listing Listing) error {
+	if listing.Instance != n.Instance {
+		return fmt.Errorf("listing is of instance %s, not %s", listing.Instance, n.Instance)
+	}
+	return nil
 }
 
 // ListFiles lists the files that the node is watching.
@@ -53,3 +255,15 @@ func (n *Node) ListFiles() []string {
 	n.mux.RUnlock()
 	return files
 }
+
+// Files lists the files that the node is watching along
+// with their metadata.
+func (n *Node) Files() []File {
+	n.mux.RLock()
+	files := make([]File, 0, len(n.files))
+	for name, info := range n.files {
+		files = append(files, File{Filename: name, FileInfo: info})
+	}
+	n.mux.RUnlock()
+	return files
+}
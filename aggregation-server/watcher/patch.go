@@ -0,0 +1,109 @@
+package watcher
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NodeOperation is an operation on the files of one node.
+type NodeOperation struct {
+	Node *Node
+	Operation
+}
+
+// PatchError is why the operations of a JSON Patch document couldn't be
+// applied, naming the first that couldn't.
+type PatchError struct {
+	// Index is the position of the operation in the document.
+	Index  int
+	Reason string
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("operation %d: %s", e.Index, e.Reason)
+}
+
+// pendingNode is the state of a node as the operations of a JSON Patch
+// document before the one being checked would leave it.
+type pendingNode struct {
+	seqno int
+	// exists holds whether files changed by earlier operations exist.
+	exists map[string]bool
+}
+
+func (p *pendingNode) has(n *Node, filename string) bool {
+	if exists, ok := p.exists[filename]; ok {
+		return exists
+	}
+	_, ok := n.files[filename]
+	return ok
+}
+
+// ApplyPatch carries out the operations of a JSON Patch document, which
+// RFC 6902 requires to be applied all or not at all. Every operation is
+// checked, with the locks of all the nodes it changes held, before any
+// is applied, and a *PatchError is returned if one can't be.
+//
+// Operations must follow on from the node's sequence as those sent by
+// watcher nodes do. Those without a sequence number may only change nodes
+// that aren't kept in sequence, since the node would otherwise have no
+// record of them. As RFC 6902 requires, a file must exist to be removed
+// or replaced.
+func ApplyPatch(ops []NodeOperation) error {
+	nodes := make([]*Node, 0)
+	pending := make(map[*Node]*pendingNode)
+	for _, op := range ops {
+		if _, ok := pending[op.Node]; !ok {
+			nodes = append(nodes, op.Node)
+			pending[op.Node] = &pendingNode{exists: make(map[string]bool)}
+		}
+	}
+	// Nodes are always locked in the same order, so that
+	// documents changing the same nodes can't deadlock.
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Instance.String() < nodes[j].Instance.String()
+	})
+	for _, n := range nodes {
+		n.mux.Lock()
+		defer n.mux.Unlock()
+		pending[n].seqno = n.seqno
+	}
+
+	for i, op := range ops {
+		n, p := op.Node, pending[op.Node]
+		if op.Epoch != 0 && op.Epoch != n.epoch {
+			return &PatchError{i, fmt.Sprintf("node %s is in epoch %d, not %d", n.Instance, n.epoch, op.Epoch)}
+		}
+		if op.SeqNo == 0 {
+			if p.seqno != NoSequence {
+				return &PatchError{i, fmt.Sprintf("node %s is kept in sequence, so operations on it need a seqno", n.Instance)}
+			}
+		} else {
+			if p.seqno != NoSequence && op.follows() != p.seqno {
+				return &PatchError{i, fmt.Sprintf("seqno %d doesn't follow node %s's sequence %d", op.SeqNo, n.Instance, p.seqno)}
+			}
+			p.seqno = op.SeqNo
+		}
+		switch op.Type {
+		case addOperation:
+			p.exists[op.Filename] = true
+		case modifyOperation:
+			if !p.has(n, op.Filename) {
+				return &PatchError{i, fmt.Sprintf("node %s has no file %q to replace", n.Instance, op.Filename)}
+			}
+		case removeOperation:
+			if !p.has(n, op.Filename) {
+				return &PatchError{i, fmt.Sprintf("node %s has no file %q to remove", n.Instance, op.Filename)}
+			}
+			p.exists[op.Filename] = false
+		}
+	}
+
+	for _, op := range ops {
+		op.Node.apply(op.Operation)
+	}
+	for _, n := range nodes {
+		n.seqno = pending[n].seqno
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package watcher
+
+import (
+	"expvar"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// reconcileStats counts the work of reconcilers, published
+// under "reconcile" at /debug/vars.
+var reconcileStats = expvar.NewMap("reconcile")
+
+// Reconciler periodically fetches the file list of each registered node
+// and repairs any drift from the copy built up from pushed operations.
+type Reconciler struct {
+	reg         *Registry
+	interval    time.Duration
+	concurrency int
+	// fetch gets a node's file list, GetNodeFiles unless replaced in tests.
+	fetch func(*url.URL) (Listing, error)
+
+	// static holds the nodes configured by address rather than
+	// registered by hello, with the instance last found at each.
+	static    []*staticNode
+	subscribe string
+	secret    []byte
+}
+
+// staticNode is a node the aggregator polls without it saying hello.
+type staticNode struct {
+	address  *url.URL
+	instance uuid.UUID
+	// epoch is the run of the node subscribed to, as a node
+	// forgets its subscription when it restarts.
+	epoch      int
+	subscribed bool
+}
+
+// NewReconciler returns a reconciler that checks the nodes of reg every
+// interval, fetching up to concurrency file lists at once.
+func NewReconciler(reg *Registry, interval time.Duration, concurrency int) *Reconciler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Reconciler{
+		reg:         reg,
+		interval:    interval,
+		concurrency: concurrency,
+		fetch:       GetNodeFiles,
+	}
+}
+
+// AddStatic has the reconciler poll the watcher node whose files are at
+// address, registering it without it having to say hello. If subscribe
+// is set, the node is asked to push its changes to the aggregator at that
+// URL once it has been registered, signing the request with secret.
+func (rc *Reconciler) AddStatic(address *url.URL, subscribe string, secret []byte) {
+	rc.static = append(rc.static, &staticNode{address: address})
+	rc.subscribe, rc.secret = subscribe, secret
+}
+
+// Run reconciles nodes every interval until stop is closed. Static
+// nodes are registered straight away rather than after an interval.
+func (rc *Reconciler) Run(stop <-chan struct{}) {
+	if len(rc.static) > 0 {
+		rc.Reconcile()
+	}
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rc.Reconcile()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reconcile checks every registered node once, returning the
+// number of discrepancies repaired.
+func (rc *Reconciler) Reconcile() int {
+	// Static nodes are checked at their configured address, so
+	// aren't checked again as registered nodes.
+	static := make(map[uuid.UUID]bool, len(rc.static))
+	for _, sn := range rc.static {
+		static[sn.instance] = true
+	}
+	nodes := make([]*Node, 0)
+	for _, node := range rc.reg.Nodes() {
+		if !static[node.Instance] {
+			nodes = append(nodes, node)
+		}
+	}
+	reconcileStats.Add("runs", 1)
+
+	var (
+		wg       sync.WaitGroup
+		mux      sync.Mutex
+		repaired int
+	)
+	queue := make(chan func() int)
+	for i := 0; i < rc.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range queue {
+				differences := check()
+				mux.Lock()
+				repaired += differences
+				mux.Unlock()
+			}
+		}()
+	}
+	for _, node := range nodes {
+		node := node
+		queue <- func() int { return rc.reconcileNode(node) }
+	}
+	for _, sn := range rc.static {
+		sn := sn
+		queue <- func() int { return rc.reconcileStatic(sn) }
+	}
+	close(queue)
+	wg.Wait()
+
+	if repaired > 0 {
+		rc.reg.log.WithField("discrepancies", repaired).Warnln("Repaired drift from watcher nodes")
+	} else {
+		rc.reg.log.WithField("nodes", len(nodes)+len(rc.static)).Debugln("Reconciled watcher nodes")
+	}
+	return repaired
+}
+
+func (rc *Reconciler) reconcileNode(node *Node) int {
+	address := node.Address()
+	if address == nil {
+		return 0
+	}
+	reconcileStats.Add("nodes", 1)
+	listing, err := rc.fetch(address)
+	if err != nil {
+		reconcileStats.Add("errors", 1)
+		rc.reg.log.WithField("node-id", node.Instance).Errorf("error reconciling node: %v", err)
+		return 0
+	}
+	return rc.repair(node, listing)
+}
+
+// reconcileStatic fetches the files of a static node, registering it
+// under the instance found at its address.
+func (rc *Reconciler) reconcileStatic(sn *staticNode) int {
+	reconcileStats.Add("nodes", 1)
+	listing, err := rc.fetch(sn.address)
+	if err != nil {
+		reconcileStats.Add("errors", 1)
+		rc.reg.log.WithField("address", sn.address).Errorf("error polling static node: %v", err)
+		return 0
+	}
+
+	// A node that has lost its state comes back as a new instance,
+	// which replaces the old one.
+	if sn.instance != uuid.Nil && sn.instance != listing.Instance {
+		rc.reg.RemoveNode(sn.instance)
+	}
+	if sn.instance != listing.Instance || sn.epoch != listing.Epoch {
+		sn.subscribed = false
+	}
+	sn.instance, sn.epoch = listing.Instance, listing.Epoch
+
+	node, isNew := rc.reg.Register(listing.Instance)
+	node.SetLabel(listing.Label)
+	if isNew || node.Address() == nil {
+		address := *sn.address
+		query := address.Query()
+		query.Set("instance", listing.Instance.String())
+		address.RawQuery = query.Encode()
+		node.SetAddress(&address)
+	}
+	differences := 0
+	if isNew {
+		if err := node.Resync(listing); err != nil {
+			rc.reg.log.WithField("address", sn.address).Errorf("error polling static node: %v", err)
+		}
+	} else {
+		differences = rc.repair(node, listing)
+	}
+
+	if rc.subscribe != "" && !sn.subscribed {
+		if err := Subscribe(sn.address, rc.subscribe, rc.secret); err != nil {
+			rc.reg.log.WithField("address", sn.address).Errorf("error subscribing to static node: %v", err)
+		} else {
+			sn.subscribed = true
+		}
+	}
+	return differences
+}
+
+// repair reconciles node with a listing fetched from it.
+func (rc *Reconciler) repair(node *Node, listing Listing) int {
+	differences, err := node.Reconcile(listing)
+	if err != nil {
+		reconcileStats.Add("errors", 1)
+		rc.reg.log.WithField("node-id", node.Instance).Errorf("error reconciling node: %v", err)
+		return 0
+	}
+	if differences > 0 {
+		reconcileStats.Add("repaired_nodes", 1)
+		reconcileStats.Add("discrepancies", int64(differences))
+		rc.reg.log.WithField("node-id", node.Instance).Infof("Repaired %d files that differed from the node", differences)
+	}
+	return differences
+}
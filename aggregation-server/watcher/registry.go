@@ -6,19 +6,40 @@ import (
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"thirdlight.com/protocol"
 )
 
 const (
 	addOperation    = "add"
 	removeOperation = "remove"
+	modifyOperation = "modify"
 
 	// NoSequence reqresents a nodes sequence
 	// value that's not yet initialised.
 	NoSequence = -1
 )
 
+// The outcomes of an operation sent to a node.
+const (
+	// StatusApplied means the operation was carried out.
+	StatusApplied = protocol.StatusApplied
+	// StatusDuplicate means the node is already past the operation.
+	StatusDuplicate = protocol.StatusDuplicate
+	// StatusOutOfSequence means operations before this one are missing.
+	StatusOutOfSequence = protocol.StatusOutOfSequence
+	// StatusStaleEpoch means the operation is from an earlier run of the node.
+	StatusStaleEpoch = protocol.StatusStaleEpoch
+	// StatusUnknownNode means the operation is for a node that isn't registered.
+	StatusUnknownNode = protocol.StatusUnknownNode
+)
+
 // Registry stores a map of nodes that want to send file
 // operations.
+//
+// The registry's lock guards only the map of nodes, and each node's
+// lock only that node's state. Neither lock is held while taking the
+// other, so callers are free to use nodes returned by the registry
+// while other goroutines register and remove nodes.
 type Registry struct {
 	nodes map[uuid.UUID]*Node
 	mux   sync.RWMutex
@@ -40,37 +61,48 @@ func defaultLogger() *logrus.Logger {
 	return log.New()
 }
 
+// Register adds a node with the given id to the registry if it isn't
+// already there. Returns the node, and true if it was added.
+func (r *Registry) Register(id uuid.UUID) (*Node, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if node, nodeExists := r.nodes[id]; nodeExists {
+		return node, false
+	}
+	r.log.WithField("node-id", id).Infoln("Adding node")
+	node := &Node{
+		Instance: id,
+		seqno:    NoSequence,
+		files:    make(map[string]FileInfo),
+	}
+	r.nodes[id] = node
+	return node, true
+}
+
 // AddNode adds a node to the registry. Returns true if the node
 // was added and did not exist before, otherwise returns false.
 // AddNode also returns a channel to directly add filenames to a node via,
 // and done channel that will receive a value when all the filenames are read
 // from the file channel.
-func (r *Registry) AddNode(id uuid.UUID) (chan string, chan struct{}, bool) {
-	if _, nodeExists := r.nodes[id]; !nodeExists {
-		r.log.WithField("node-id", id).Infoln("Adding node")
-		fileMap := make(map[string]struct{})
-		node := &Node{
-			Instance: id,
-			seqno:    NoSequence,
-			files:    fileMap,
-		}
-		r.mux.Lock()
-		r.nodes[id] = node
-		r.mux.Unlock()
-
-		fileChan := make(chan string)
-		done := make(chan struct{})
-		go func() {
-			for file := range fileChan {
-				node.mux.Lock()
-				node.files[file] = struct{}{}
-				node.mux.Unlock()
-			}
-			done <- struct{}{}
-		}()
-		return fileChan, done, true
+func (r *Registry) AddNode(id uuid.UUID) (chan File, chan struct{}, bool) {
+	node, isNew := r.Register(id)
+	if !isNew {
+		return nil, nil, false
 	}
-	return nil, nil, false
+
+	fileChan := make(chan File)
+	// done is buffered so the goroutine can finish
+	// even if nobody waits for it.
+	done := make(chan struct{}, 1)
+	go func() {
+		for file := range fileChan {
+			node.mux.Lock()
+			node.files[file.Filename] = file.FileInfo
+			node.mux.Unlock()
+		}
+		done <- struct{}{}
+	}()
+	return fileChan, done, true
 }
 
 // RemoveNode removes a node with the given id from the
@@ -87,18 +119,38 @@ func (r *Registry) RemoveNode(id uuid.UUID) {
 // Node returns the watcher node with the given id, or nil if the node doesn't exist.
 func (r *Registry) Node(id uuid.UUID) *Node {
 	r.mux.RLock()
+	defer r.mux.RUnlock()
 	if node, nodeExists := r.nodes[id]; nodeExists {
-		r.mux.RUnlock()
 		return node
 	}
 	return nil
 }
 
+// Nodes returns the nodes currently registered.
+func (r *Registry) Nodes() []*Node {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	nodes := make([]*Node, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
 // ListFiles returns a slice of filenames held
 // by all nodes currently registered.
 func (r *Registry) ListFiles() []string {
+	return r.ListFilesWhere(nil)
+}
+
+// ListFilesWhere returns the filenames held by the registered nodes
+// that match returns true for, or by all of them if match is nil.
+func (r *Registry) ListFilesWhere(match func(*Node) bool) []string {
 	files := make([]string, 0)
-	for _, node := range r.nodes {
+	for _, node := range r.Nodes() {
+		if match != nil && !match(node) {
+			continue
+		}
 		files = append(files, node.ListFiles()...)
 	}
 	r.log.Debugln("listing files: ", files)
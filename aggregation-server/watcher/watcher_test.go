@@ -1,9 +1,16 @@
 package watcher
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"thirdlight.com/protocol"
 )
 
 // TestAddNode checks that nodes can be added to the registry and
@@ -14,8 +21,8 @@ func TestAddNode(t *testing.T) {
 
 	filechan, done, added := reg.AddNode(uuid.New())
 	if added {
-		filechan <- "file1.txt"
-		filechan <- "file2.txt"
+		filechan <- File{Filename: "file1.txt"}
+		filechan <- File{Filename: "file2.txt"}
 		close(filechan)
 		<-done
 		fileCount := len(reg.ListFiles())
@@ -49,8 +56,8 @@ func TestRemoveNode(t *testing.T) {
 	id := uuid.New()
 	filechan, done, added := reg.AddNode(id)
 	if added {
-		filechan <- "file1.txt"
-		filechan <- "file2.txt"
+		filechan <- File{Filename: "file1.txt"}
+		filechan <- File{Filename: "file2.txt"}
 		close(filechan)
 		<-done
 
@@ -117,3 +124,350 @@ func TestRemoveOperation(t *testing.T) {
 		t.Errorf("expected 0 files, got %d", fileCount)
 	}
 }
+
+func TestDuplicates(t *testing.T) {
+	reg := NewRegistry(nil)
+
+	first, second := uuid.New(), uuid.New()
+	reg.AddNode(first)
+	reg.AddNode(second)
+	reg.Node(first).Do(Operation{
+		Type:     "add",
+		SeqNo:    1,
+		Filename: "cat.jpg",
+		FileInfo: FileInfo{Size: 10, Hash: "aaaa"},
+	})
+	reg.Node(first).Do(Operation{
+		Type:     "add",
+		SeqNo:    2,
+		Filename: "dog.jpg",
+		FileInfo: FileInfo{Size: 20, Hash: "bbbb"},
+	})
+	reg.Node(second).Do(Operation{
+		Type:     "add",
+		SeqNo:    1,
+		Filename: "kitten.jpg",
+		FileInfo: FileInfo{Size: 10, Hash: "aaaa"},
+	})
+
+	groups := reg.Duplicates()
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 duplicate group, got %d", len(groups))
+	}
+	if groups[0].Hash != "aaaa" || len(groups[0].Files) != 2 {
+		t.Errorf("unexpected duplicate group: %+v", groups[0])
+	}
+	if groups[0].Wasted != 10 {
+		t.Errorf("expected 10 wasted bytes, got %d", groups[0].Wasted)
+	}
+}
+
+// TestNodeCapabilities checks that a node is assumed to support
+// everything until it reports what it supports, and that duplicates
+// aren't looked for among the files of a node without metadata.
+func TestNodeCapabilities(t *testing.T) {
+	reg := NewRegistry(nil)
+	first, second := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{first, second} {
+		node, _ := reg.Register(id)
+		node.Do(Operation{Type: "add", SeqNo: 1, Filename: "cat.jpg", FileInfo: FileInfo{Size: 10, Hash: "aaaa"}})
+	}
+
+	node := reg.Node(second)
+	if !node.Supports(protocol.CapabilityMetadata) {
+		t.Error("expected a node that hasn't reported capabilities to support metadata")
+	}
+	node.SetProtocol(1, []string{protocol.CapabilityChanges})
+	if node.Version() != 1 || !node.Supports(protocol.CapabilityChanges) || node.Supports(protocol.CapabilityMetadata) {
+		t.Errorf("unexpected capabilities for version %d", node.Version())
+	}
+	if groups := reg.Duplicates(); len(groups) != 0 {
+		t.Errorf("expected no duplicates from a node without metadata, got %+v", groups)
+	}
+
+	node.SetProtocol(0, nil)
+	if groups := reg.Duplicates(); len(groups) != 1 {
+		t.Errorf("expected 1 duplicate group, got %d", len(groups))
+	}
+}
+
+// TestCollapsedOperation checks that an operation following on from
+// dropped operations is applied when its previous sequence number matches.
+func TestCollapsedOperation(t *testing.T) {
+	reg := NewRegistry(nil)
+
+	id := uuid.New()
+	reg.AddNode(id)
+	reg.Node(id).Do(Operation{Type: "add", SeqNo: 1, Filename: "file1.txt"})
+	reg.Node(id).Do(Operation{Type: "add", SeqNo: 4, PrevSeqNo: 1, Filename: "file2.txt"})
+	reg.Node(id).Do(Operation{Type: "add", SeqNo: 6, Filename: "file3.txt"})
+
+	fileCount := len(reg.ListFiles())
+	if fileCount != 2 {
+		t.Errorf("expected 2 files, got %d", fileCount)
+	}
+}
+
+// TestStaleEpochOperation checks that operations from an earlier run
+// of a node are ignored once the node has been resynced.
+func TestStaleEpochOperation(t *testing.T) {
+	reg := NewRegistry(nil)
+
+	id := uuid.New()
+	node, _ := reg.Register(id)
+	node.Resync(Listing{
+		Instance: id,
+		Files:    []File{{Filename: "file1.txt"}},
+		Epoch:    2,
+		SeqNo:    10,
+	})
+	node.Do(Operation{Type: "add", Epoch: 1, SeqNo: 11, Filename: "stale.txt"})
+	node.Do(Operation{Type: "add", Epoch: 2, SeqNo: 11, Filename: "file2.txt"})
+
+	files := reg.ListFiles()
+	if len(files) != 2 {
+		t.Errorf("expected 2 files, got %v", files)
+	}
+}
+
+// TestOperationStatus checks the outcome reported for operations
+// in and out of sequence.
+func TestOperationStatus(t *testing.T) {
+	reg := NewRegistry(nil)
+
+	id := uuid.New()
+	node, _ := reg.Register(id)
+	node.Resync(Listing{Instance: id, Epoch: 2, SeqNo: 5})
+
+	tests := []struct {
+		op     Operation
+		status string
+	}{
+		{Operation{Type: "add", Epoch: 2, SeqNo: 6, Filename: "a.txt"}, StatusApplied},
+		{Operation{Type: "add", Epoch: 2, SeqNo: 6, Filename: "a.txt"}, StatusDuplicate},
+		{Operation{Type: "add", Epoch: 2, SeqNo: 9, Filename: "b.txt"}, StatusOutOfSequence},
+		{Operation{Type: "add", Epoch: 2, SeqNo: 9, PrevSeqNo: 6, Filename: "b.txt"}, StatusApplied},
+		{Operation{Type: "add", Epoch: 1, SeqNo: 10, Filename: "c.txt"}, StatusStaleEpoch},
+		{Operation{Type: "add", Filename: "d.txt"}, StatusDuplicate},
+	}
+	for _, test := range tests {
+		if status := node.Do(test.op); status != test.status {
+			t.Errorf("seqno %d: expected %q, got %q", test.op.SeqNo, test.status, status)
+		}
+	}
+	if node.Sequence() != 9 || len(node.ListFiles()) != 2 {
+		t.Errorf("expected 2 files at sequence 9, got %v at %d", node.ListFiles(), node.Sequence())
+	}
+}
+
+// TestReconcile checks that drift from a node's file list is repaired,
+// that only a listing at the sequence number applied is counted as
+// drift, and that a listing older than the operations applied, or of
+// another instance, is ignored.
+func TestReconcile(t *testing.T) {
+	reg := NewRegistry(nil)
+
+	id := uuid.New()
+	node, _ := reg.Register(id)
+	node.SetAddress(&url.URL{Scheme: "http", Host: "watcher", Path: "/files"})
+	node.Do(Operation{Type: "add", SeqNo: 1, Filename: "file1.txt"})
+	node.Do(Operation{Type: "add", SeqNo: 2, Filename: "file2.txt"})
+
+	listing := Listing{
+		Instance: id,
+		Files:    []File{{Filename: "file1.txt"}, {Filename: "file3.txt"}},
+		SeqNo:    2,
+	}
+	rc := NewReconciler(reg, time.Minute, 2)
+	rc.fetch = func(*url.URL) (Listing, error) {
+		return listing, nil
+	}
+	if repaired := rc.Reconcile(); repaired != 2 {
+		t.Errorf("expected 2 discrepancies repaired, got %d", repaired)
+	}
+	if files := node.ListFiles(); len(files) != 2 {
+		t.Errorf("expected 2 files, got %v", files)
+	}
+
+	node.Do(Operation{Type: "add", SeqNo: 3, Filename: "file4.txt"})
+	if repaired := rc.Reconcile(); repaired != 0 {
+		t.Errorf("expected outdated listing to be ignored, got %d discrepancies", repaired)
+	}
+	if files := node.ListFiles(); len(files) != 3 {
+		t.Errorf("expected 3 files, got %v", files)
+	}
+
+	listing = Listing{Instance: id, Files: []File{{Filename: "file5.txt"}}, SeqNo: 5}
+	if repaired := rc.Reconcile(); repaired != 0 {
+		t.Errorf("expected a later listing not to count as drift, got %d discrepancies", repaired)
+	}
+	if files := node.ListFiles(); len(files) != 1 || node.Sequence() != 5 {
+		t.Errorf("expected the later listing's file at sequence 5, got %v at %d", files, node.Sequence())
+	}
+
+	listing = Listing{Instance: uuid.New(), Files: []File{{Filename: "other.txt"}}, SeqNo: 5}
+	if repaired := rc.Reconcile(); repaired != 0 {
+		t.Errorf("expected listing of another instance to be ignored, got %d discrepancies", repaired)
+	}
+	if files := node.ListFiles(); len(files) != 1 || files[0] != "file5.txt" {
+		t.Errorf("expected listing of another instance to be ignored, got %v", files)
+	}
+	if err := node.Resync(listing); err == nil {
+		t.Error("expected resync from a listing of another instance to be refused")
+	}
+}
+
+// TestStaticNode checks that a node configured by address is registered
+// under the instance found there, and replaced if the instance changes.
+func TestStaticNode(t *testing.T) {
+	reg := NewRegistry(nil)
+
+	first, second := uuid.New(), uuid.New()
+	listing := Listing{
+		Instance: first,
+		Label:    "docs",
+		Files:    []File{{Filename: "file1.txt"}},
+		Epoch:    1,
+		SeqNo:    4,
+	}
+	rc := NewReconciler(reg, time.Minute, 1)
+	rc.fetch = func(*url.URL) (Listing, error) {
+		return listing, nil
+	}
+	rc.AddStatic(&url.URL{Scheme: "http", Host: "watcher:4000", Path: "/files"}, "", nil)
+	rc.Reconcile()
+
+	node := reg.Node(first)
+	if node == nil {
+		t.Fatal("expected static node to be registered")
+	}
+	if node.Label() != "docs" || node.Sequence() != 4 || len(node.ListFiles()) != 1 {
+		t.Errorf("unexpected static node state: %q at %d with %v", node.Label(), node.Sequence(), node.ListFiles())
+	}
+	if address := node.Address().String(); address != "http://watcher:4000/files?instance="+first.String() {
+		t.Errorf("unexpected static node address %s", address)
+	}
+
+	listing.Instance = second
+	rc.Reconcile()
+	if reg.Node(first) != nil || reg.Node(second) == nil {
+		t.Error("expected static node to be replaced by its new instance")
+	}
+}
+
+// TestGetNodeChanges checks that changes are fetched from beside a
+// node's files, and that changes the node no longer holds are reported.
+func TestGetNodeChanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance := r.URL.Query().Get("instance")
+		if r.URL.Path != "/changes" || instance == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("since") != "3" {
+			http.Error(w, "changes no longer held", http.StatusGone)
+			return
+		}
+		fmt.Fprintf(w, `{"instance":%[1]q,"epoch":2,"seqno":5,"changes":[`+
+			`{"instance":%[1]q,"epoch":2,"op":"add","seqno":4,"value":{"filename":"a.txt","size":1,"hash":"aa"}},`+
+			`{"instance":%[1]q,"epoch":2,"op":"remove","seqno":5,"value":{"filename":"b.txt","size":0}}]}`, instance)
+	}))
+	defer srv.Close()
+
+	address, _ := url.Parse(srv.URL + "/files?instance=" + uuid.New().String())
+	changes, err := GetNodeChanges(address, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.Epoch != 2 || changes.SeqNo != 5 || len(changes.Operations) != 2 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	expected := Operation{Type: "add", Epoch: 2, SeqNo: 4, Filename: "a.txt", FileInfo: FileInfo{Size: 1, Hash: "aa"}}
+	if changes.Operations[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, changes.Operations[0])
+	}
+
+	if _, err := GetNodeChanges(address, 1); err != ErrChangesGone {
+		t.Errorf("expected ErrChangesGone, got %v", err)
+	}
+}
+
+// TestGetNodeFiles checks that a node's file list is fetched, and that
+// an error response is reported even when its body reads as a listing.
+func TestGetNodeFiles(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"instance":%q,"label":"docs","epoch":2,"seqno":5,"files":[{"filename":"a.txt","size":1,"hash":"aa"}]}`,
+			r.URL.Query().Get("instance"))
+	}))
+	defer srv.Close()
+
+	id := uuid.New()
+	address, _ := url.Parse(srv.URL + "/files?instance=" + id.String())
+	listing, err := GetNodeFiles(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing.Instance != id || listing.Label != "docs" || listing.Epoch != 2 || listing.SeqNo != 5 || len(listing.Files) != 1 {
+		t.Errorf("unexpected listing: %+v", listing)
+	}
+
+	status = http.StatusServiceUnavailable
+	if _, err := GetNodeFiles(address); err == nil {
+		t.Error("expected an error response to be reported")
+	}
+}
+
+// TestRegistryStress exercises the registry and its nodes from many
+// goroutines at once, to be run with the race detector.
+func TestRegistryStress(t *testing.T) {
+	reg := NewRegistry(nil)
+	ids := make([]uuid.UUID, 8)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; i <= 200; i++ {
+				id := ids[(w+i)%len(ids)]
+				switch i % 8 {
+				case 0:
+					reg.RemoveNode(id)
+				case 1:
+					if node, isNew := reg.Register(id); isNew {
+						node.SetLabel("label")
+						node.Resync(Listing{Instance: id, Epoch: 1, SeqNo: i, Files: []File{{Filename: "base.txt"}}})
+					}
+				case 2:
+					reg.ListFiles()
+				case 3:
+					reg.Duplicates()
+				default:
+					if node := reg.Node(id); node != nil {
+						node.Do(Operation{
+							Type:     "add",
+							Epoch:    1,
+							SeqNo:    node.Sequence() + 1,
+							Filename: "file.txt",
+							FileInfo: FileInfo{Size: int64(i), Hash: "aaaa"},
+						})
+						node.Reconcile(Listing{Instance: id, Epoch: 1, SeqNo: node.Sequence()})
+						node.Files()
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, node := range reg.Nodes() {
+		if node.Sequence() == NoSequence {
+			t.Errorf("node %s was never given a sequence", node.Instance)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+module thirdlight.com/layered
+
+go 1.12
+
+require (
+	github.com/spf13/viper v1.7.1
+	gopkg.in/yaml.v2 v2.2.4
+)
@@ -0,0 +1,121 @@
+// Package layered reads the settings of a service in layers: from their
+// defaults, a YAML or TOML file, the environment and command line flags,
+// each overriding the last. Watcher nodes and the aggregation server are
+// configured alike with it, each describing its own settings.
+package layered
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// Setting describes one of a service's settings. Its key names it in
+// config files, the environment and the mapstructure tag of the field it
+// is read into, and its flag names it on the command line, if different.
+type Setting struct {
+	Key   string
+	Flag  string
+	Value interface{} // the default, whose type is the setting's
+	Usage string
+}
+
+// Load reads settings into cfg, a pointer to a struct with a field tagged
+// with the key of each, from, in increasing precedence, their defaults,
+// the file given by -config, environment variables named after them with
+// envPrefix, and the flags in args, defined on flags. It returns true if
+// -print-config was given.
+func Load(flags *flag.FlagSet, args []string, envPrefix string, settings []Setting, cfg interface{}) (bool, error) {
+	v := viper.New()
+	configFile := flags.String("config", os.Getenv(envPrefix+"_CONFIG"), "a YAML or TOML file to read settings from, which the environment and flags override")
+	printConfig := flags.Bool("print-config", false, "print the settings in effect as YAML and exit")
+	keys := make(map[string]string, len(settings))
+	for _, s := range settings {
+		name := s.Flag
+		if name == "" {
+			name = s.Key
+		}
+		keys[name] = s.Key
+		v.SetDefault(s.Key, s.Value)
+		switch value := s.Value.(type) {
+		case string:
+			flags.String(name, value, s.Usage)
+		case bool:
+			flags.Bool(name, value, s.Usage)
+		case int:
+			flags.Int(name, value, s.Usage)
+		case uint:
+			flags.Uint(name, value, s.Usage)
+		case time.Duration:
+			flags.Duration(name, value, s.Usage)
+		case []string:
+			flags.Var(&stringList{}, name, s.Usage)
+		default:
+			return false, fmt.Errorf("setting %s has unsupported type %T", s.Key, s.Value)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return false, err
+	}
+
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return false, fmt.Errorf("error reading %s: %v", *configFile, err)
+		}
+	}
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+	// Only flags that were given override the other sources.
+	flags.Visit(func(f *flag.Flag) {
+		if key, ok := keys[f.Name]; ok {
+			v.Set(key, f.Value.(flag.Getter).Get())
+		}
+	})
+
+	return *printConfig, v.Unmarshal(cfg)
+}
+
+// Print writes cfg, a struct read by Load, as YAML, as it could be given
+// in a file.
+func Print(w io.Writer, cfg interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(cfg))
+	out := make(yaml.MapSlice, 0, value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i).Interface()
+		if d, ok := field.(time.Duration); ok {
+			field = d.String()
+		}
+		out = append(out, yaml.MapItem{Key: value.Type().Field(i).Tag.Get("mapstructure"), Value: field})
+	}
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// stringList is a flag that can be repeated to build up a list of values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) Get() interface{} {
+	return []string(*l)
+}
@@ -0,0 +1,13 @@
+module thirdlight.com/protocol
+
+go 1.12
+
+require (
+	github.com/golang/protobuf v1.3.3
+	github.com/google/uuid v1.1.1
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	golang.org/x/sys v0.0.0-20190624142023-c5567b49c5d0 // indirect
+	golang.org/x/text v0.3.2 // indirect
+	google.golang.org/genproto v0.0.0-20191108220845-16a3f7862a1a // indirect
+	google.golang.org/grpc v1.31.1
+)
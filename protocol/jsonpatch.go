@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MediaTypeJSONPatch is the media type of a JSON Patch document, as
+// defined by RFC 6902.
+const MediaTypeJSONPatch = "application/json-patch+json"
+
+// The JSON Patch operations that can be made on files.
+const (
+	JSONPatchAdd     = "add"
+	JSONPatchRemove  = "remove"
+	JSONPatchReplace = "replace"
+)
+
+// JSONPatchOperation is a single operation of a JSON Patch document. Its
+// path is a JSON Pointer to a file, as made by FilePointer, and the value
+// of an add or replace is the file's metadata.
+//
+// Epoch, Sequence and Previous are members added to the standard ones,
+// which tools that don't keep sequence numbers can leave out.
+type JSONPatchOperation struct {
+	Op       string          `json:"op"`
+	Path     string          `json:"path"`
+	Value    *JSONPatchValue `json:"value,omitempty"`
+	Epoch    int             `json:"epoch,omitempty"`
+	Sequence int             `json:"seqno,omitempty"`
+	Previous int             `json:"prevseqno,omitempty"`
+}
+
+// JSONPatchValue is the metadata of a file added or replaced by a JSON
+// Patch operation, named by the operation's path.
+type JSONPatchValue struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// FilePointer returns the JSON Pointer to a file of an instance.
+func FilePointer(instance, filename string) string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	return "/" + escaper.Replace(instance) + "/" + escaper.Replace(filename)
+}
+
+// ParseFilePointer returns the instance and filename a JSON Pointer made
+// by FilePointer points to.
+func ParseFilePointer(pointer string) (instance, filename string, err error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return "", "", fmt.Errorf("path %q doesn't start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	if len(tokens) != 2 {
+		return "", "", fmt.Errorf("path %q isn't of the form /<instance>/<filename>", pointer)
+	}
+	for i, token := range tokens {
+		// ~ may only be followed by 0 or 1.
+		if strings.Contains(strings.NewReplacer("~0", "", "~1", "").Replace(token), "~") {
+			return "", "", fmt.Errorf("path %q has an invalid escape", pointer)
+		}
+		// ~1 is unescaped first, so that ~01 becomes ~1 and not /.
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens[0], tokens[1], nil
+}
+
+// PatchOperation returns the operation the JSON Patch operation makes,
+// with a Sequence of zero if it has no sequence number.
+func (op JSONPatchOperation) PatchOperation() (PatchOperation, error) {
+	instance, filename, err := ParseFilePointer(op.Path)
+	if err != nil {
+		return PatchOperation{}, err
+	}
+	patch := PatchOperation{
+		BaseMessage: BaseMessage{Instance: instance, Epoch: op.Epoch},
+		Value:       FileMetadata{Filename: filename},
+		Sequence:    op.Sequence,
+		Previous:    op.Previous,
+	}
+	switch op.Op {
+	case JSONPatchAdd, JSONPatchReplace:
+		if op.Value == nil {
+			return PatchOperation{}, fmt.Errorf("%s of %q has no value", op.Op, op.Path)
+		}
+		patch.Value.Size = op.Value.Size
+		patch.Value.Hash = op.Value.Hash
+		patch.Op = OpAdd
+		if op.Op == JSONPatchReplace {
+			patch.Op = OpModify
+		}
+	case JSONPatchRemove:
+		patch.Op = OpRemove
+	default:
+		return PatchOperation{}, fmt.Errorf("unsupported op %q, expected add, remove or replace", op.Op)
+	}
+
+	if err := patch.BaseMessage.Validate(); err != nil {
+		return PatchOperation{}, err
+	}
+	if err := patch.Value.Validate(); err != nil {
+		return PatchOperation{}, err
+	}
+	if patch.Sequence == 0 {
+		if patch.Previous != 0 {
+			return PatchOperation{}, errors.New("prevseqno given without seqno")
+		}
+		return patch, nil
+	}
+	return patch, patch.Validate()
+}
@@ -0,0 +1,309 @@
+// Package protocol defines the messages exchanged between watcher nodes
+// and the aggregation server, so both are built against the same wire
+// format.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Version is the version of the protocol the messages in this package
+// make up. It is increased whenever a change would break a peer built
+// against an earlier version.
+const Version = 1
+
+// MinVersion is the earliest version of the protocol still understood.
+// Peers that don't report a version are taken to speak version 1.
+const MinVersion = 1
+
+// The optional features a watcher node can report in its hello.
+const (
+	// CapabilityMetadata means the node reports the size and hash
+	// of its files.
+	CapabilityMetadata = "supports-metadata"
+	// CapabilityChanges means the node serves the changes it has
+	// made from its /changes endpoint.
+	CapabilityChanges = "supports-changes-endpoint"
+)
+
+// Capabilities are the features of this version of the protocol.
+var Capabilities = []string{CapabilityMetadata, CapabilityChanges}
+
+// CheckVersion returns an error if a peer speaking version can't be
+// understood. A version of zero is from a peer that predates versions.
+func CheckVersion(version int) error {
+	if version == 0 {
+		return nil
+	}
+	if version < MinVersion || version > Version {
+		return fmt.Errorf("unsupported protocol version %d, expected %d to %d", version, MinVersion, Version)
+	}
+	return nil
+}
+
+// The operations a watcher node reports on its files.
+const (
+	OpAdd    = "add"
+	OpRemove = "remove"
+	OpModify = "modify"
+)
+
+// The outcomes the aggregator reports for an operation.
+const (
+	StatusApplied       = "applied"
+	StatusDuplicate     = "duplicate"
+	StatusOutOfSequence = "out-of-sequence"
+	StatusStaleEpoch    = "stale-epoch"
+	StatusUnknownNode   = "unknown-node"
+)
+
+// BaseMessage identifies the watched directory a message is about.
+type BaseMessage struct {
+	Instance string `json:"instance"`
+	// Epoch increases each time the instance restarts.
+	Epoch int `json:"epoch,omitempty"`
+}
+
+// InstanceID returns the instance as a UUID.
+func (m BaseMessage) InstanceID() (uuid.UUID, error) {
+	return uuid.Parse(m.Instance)
+}
+
+// Validate checks that the message identifies an instance.
+func (m BaseMessage) Validate() error {
+	if _, err := m.InstanceID(); err != nil {
+		return fmt.Errorf("invalid instance %q: %v", m.Instance, err)
+	}
+	if m.Epoch < 0 {
+		return fmt.Errorf("invalid epoch %d", m.Epoch)
+	}
+	return nil
+}
+
+// FileMetadata describes a single file in a watched directory. Hash is
+// the SHA-256 of the file's content, and is empty for directories.
+type FileMetadata struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Validate checks that the file is named and has a sensible size.
+func (f FileMetadata) Validate() error {
+	if f.Filename == "" {
+		return errors.New("missing filename")
+	}
+	if strings.ContainsRune(f.Filename, '/') {
+		return fmt.Errorf("filename %q contains a path separator", f.Filename)
+	}
+	if f.Size < 0 {
+		return fmt.Errorf("invalid size %d for %q", f.Size, f.Filename)
+	}
+	return nil
+}
+
+// ListResponse is a watcher node's full file list for one directory.
+type ListResponse struct {
+	BaseMessage
+	Label    string         `json:"label,omitempty"`
+	Files    []FileMetadata `json:"files"`
+	Sequence int            `json:"seqno"`
+}
+
+// Validate checks the listing and each of its files.
+func (l ListResponse) Validate() error {
+	if err := l.BaseMessage.Validate(); err != nil {
+		return err
+	}
+	if l.Sequence < 0 {
+		return fmt.Errorf("invalid seqno %d", l.Sequence)
+	}
+	for _, file := range l.Files {
+		if err := file.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PatchOperation is a single change to a watched directory.
+type PatchOperation struct {
+	BaseMessage
+	Op       string       `json:"op"`
+	Value    FileMetadata `json:"value"`
+	Sequence int          `json:"seqno"`
+	// Previous is the sequence number this operation follows, when
+	// operations between have been collapsed and it isn't Sequence-1.
+	Previous int `json:"prevseqno,omitempty"`
+}
+
+// Validate checks the operation is one that can be applied.
+func (op PatchOperation) Validate() error {
+	if err := op.BaseMessage.Validate(); err != nil {
+		return err
+	}
+	switch op.Op {
+	case OpAdd, OpRemove, OpModify:
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	if op.Sequence < 1 {
+		return fmt.Errorf("invalid seqno %d", op.Sequence)
+	}
+	if op.Previous < 0 || op.Previous >= op.Sequence {
+		return fmt.Errorf("prevseqno %d doesn't come before seqno %d", op.Previous, op.Sequence)
+	}
+	return op.Value.Validate()
+}
+
+// PatchResult is the outcome of a single operation, one of the
+// Status values.
+type PatchResult struct {
+	Instance string `json:"instance"`
+	Sequence int    `json:"seqno"`
+	Status   string `json:"status"`
+}
+
+// NodeSequence is the highest sequence number the aggregator has
+// applied for an instance without a gap.
+type NodeSequence struct {
+	BaseMessage
+	Sequence int `json:"seqno"`
+}
+
+// PatchResponse is the reply to a set of operations. Results holds the
+// outcome of each operation in the order they were sent, and Nodes
+// where each instance the operations were for now stands.
+type PatchResponse struct {
+	Results []PatchResult  `json:"results"`
+	Nodes   []NodeSequence `json:"nodes"`
+}
+
+// ChangesResponse lists the operations made since a sequence number,
+// bringing the store up to Sequence.
+type ChangesResponse struct {
+	BaseMessage
+	Label      string           `json:"label,omitempty"`
+	Operations []PatchOperation `json:"changes"`
+	Sequence   int              `json:"seqno"`
+}
+
+// Validate checks the changes are valid operations of the instance,
+// in order and no later than the sequence number they bring it up to.
+func (c ChangesResponse) Validate() error {
+	if err := c.BaseMessage.Validate(); err != nil {
+		return err
+	}
+	previous := 0
+	for _, op := range c.Operations {
+		if err := op.Validate(); err != nil {
+			return err
+		}
+		if op.Instance != c.Instance {
+			return fmt.Errorf("change %d is for instance %s", op.Sequence, op.Instance)
+		}
+		if op.Sequence <= previous || op.Sequence > c.Sequence {
+			return fmt.Errorf("change %d is out of order", op.Sequence)
+		}
+		previous = op.Sequence
+	}
+	return nil
+}
+
+// HelloOperation registers a watched directory with the aggregator.
+type HelloOperation struct {
+	BaseMessage
+	Port  uint   `json:"port"`
+	Label string `json:"label,omitempty"`
+	// Sequence is the sequence number of the last operation
+	// delivered to the aggregator, or zero if not known.
+	Sequence int `json:"seqno,omitempty"`
+	// Advertise is the base URL the node can be reached at, for
+	// when the aggregator can't reach it at its remote address.
+	Advertise string `json:"advertise,omitempty"`
+	// TLS is set when the node serves its files over https, for
+	// when the aggregator reaches it at its remote address.
+	TLS bool `json:"tls,omitempty"`
+	// Version is the protocol version the node speaks, and
+	// Capabilities the optional features it supports. Both are
+	// left out by nodes that predate them.
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Negotiated returns true if the node reported its version and
+// capabilities, rather than predating them.
+func (h HelloOperation) Negotiated() bool {
+	return h.Version != 0
+}
+
+// Supports returns true if the node reported a capability.
+func (h HelloOperation) Supports(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the hello says where the node can be reached.
+func (h HelloOperation) Validate() error {
+	if err := h.BaseMessage.Validate(); err != nil {
+		return err
+	}
+	if h.Advertise == "" && (h.Port == 0 || h.Port > 65535) {
+		return fmt.Errorf("invalid port %d", h.Port)
+	}
+	if h.Advertise != "" {
+		if err := validateURL(h.Advertise); err != nil {
+			return fmt.Errorf("invalid advertised address: %v", err)
+		}
+	}
+	if h.Sequence < 0 {
+		return fmt.Errorf("invalid seqno %d", h.Sequence)
+	}
+	if h.Version < 0 {
+		return fmt.Errorf("invalid protocol version %d", h.Version)
+	}
+	return nil
+}
+
+// ByeOperation unregisters a watched directory from the aggregator.
+type ByeOperation struct {
+	BaseMessage
+}
+
+// Validate checks the bye identifies an instance.
+func (b ByeOperation) Validate() error {
+	return b.BaseMessage.Validate()
+}
+
+// SubscribeRequest asks a node to push its changes to an aggregator.
+type SubscribeRequest struct {
+	Aggregator string `json:"aggregator"`
+}
+
+// Validate checks the aggregator's address is an http URL.
+func (s SubscribeRequest) Validate() error {
+	if err := validateURL(s.Aggregator); err != nil {
+		return fmt.Errorf("invalid aggregator address: %v", err)
+	}
+	return nil
+}
+
+func validateURL(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http URL", address)
+	}
+	return nil
+}
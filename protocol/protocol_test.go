@@ -0,0 +1,419 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const instance = "56d1a8de-14a8-403b-b3e7-d49307c63553"
+
+// messages are examples of each message, kept in testdata as the JSON
+// they must be encoded as, so that changes to the wire format are seen.
+var messages = []struct {
+	golden  string
+	message interface{}
+}{
+	{"hello.json", &HelloOperation{
+		BaseMessage:  BaseMessage{Instance: instance, Epoch: 2},
+		Port:         4001,
+		Label:        "docs",
+		Sequence:     12,
+		Advertise:    "http://watcher.example.com:4001",
+		Version:      Version,
+		Capabilities: Capabilities,
+	}},
+	{"bye.json", &ByeOperation{BaseMessage: BaseMessage{Instance: instance, Epoch: 2}}},
+	{"patch.json", &[]PatchOperation{
+		{
+			BaseMessage: BaseMessage{Instance: instance, Epoch: 2},
+			Op:          OpAdd,
+			Value:       FileMetadata{Filename: "badger.png", Size: 2048, Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+			Sequence:    3,
+		},
+		{
+			BaseMessage: BaseMessage{Instance: instance, Epoch: 2},
+			Op:          OpRemove,
+			Value:       FileMetadata{Filename: "fish.jpg"},
+			Sequence:    6,
+			Previous:    3,
+		},
+	}},
+	{"patch-response.json", &PatchResponse{
+		Results: []PatchResult{
+			{Instance: instance, Sequence: 3, Status: StatusApplied},
+			{Instance: instance, Sequence: 6, Status: StatusOutOfSequence},
+		},
+		Nodes: []NodeSequence{
+			{BaseMessage: BaseMessage{Instance: instance, Epoch: 2}, Sequence: 3},
+		},
+	}},
+	{"list.json", &ListResponse{
+		BaseMessage: BaseMessage{Instance: instance, Epoch: 2},
+		Label:       "docs",
+		Files: []FileMetadata{
+			{Filename: "file.txt", Size: 4, Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+			{Filename: "photos", Size: 4096},
+		},
+		Sequence: 3,
+	}},
+	{"changes.json", &ChangesResponse{
+		BaseMessage: BaseMessage{Instance: instance, Epoch: 2},
+		Label:       "docs",
+		Operations: []PatchOperation{
+			{
+				BaseMessage: BaseMessage{Instance: instance, Epoch: 2},
+				Op:          OpModify,
+				Value:       FileMetadata{Filename: "file.txt", Size: 5, Hash: "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"},
+				Sequence:    4,
+			},
+		},
+		Sequence: 4,
+	}},
+	{"subscribe.json", &SubscribeRequest{Aggregator: "http://127.0.0.1:8000"}},
+	{"json-patch.json", &[]JSONPatchOperation{
+		{Op: JSONPatchAdd, Path: "/" + instance + "/badger.png", Value: &JSONPatchValue{Size: 2048, Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}},
+		{Op: JSONPatchReplace, Path: "/" + instance + "/notes~0.txt", Value: &JSONPatchValue{Size: 5}, Epoch: 2, Sequence: 7},
+		{Op: JSONPatchRemove, Path: "/" + instance + "/fish.jpg"},
+	}},
+}
+
+func TestGolden(t *testing.T) {
+	for _, test := range messages {
+		path := filepath.Join("testdata", test.golden)
+		encoded, err := json.MarshalIndent(test.message, "", "    ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, '\n')
+		if *update {
+			if err := ioutil.WriteFile(path, encoded, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		golden, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, golden) {
+			t.Errorf("%s: encoding changed, got:\n%s", test.golden, encoded)
+		}
+
+		decoded := reflect.New(reflect.TypeOf(test.message).Elem()).Interface()
+		if err := json.Unmarshal(golden, decoded); err != nil {
+			t.Errorf("%s: %v", test.golden, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.message) {
+			t.Errorf("%s: decoded as %+v", test.golden, decoded)
+		}
+	}
+}
+
+// TestMinimalHello checks that a hello from a node that predates
+// epochs, sequence numbers and labels is still understood.
+func TestMinimalHello(t *testing.T) {
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "hello-minimal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hello HelloOperation
+	if err := json.Unmarshal(golden, &hello); err != nil {
+		t.Fatal(err)
+	}
+	expected := HelloOperation{BaseMessage: BaseMessage{Instance: instance}, Port: 4000}
+	if !reflect.DeepEqual(hello, expected) {
+		t.Errorf("expected %+v, got %+v", expected, hello)
+	}
+	if err := hello.Validate(); err != nil {
+		t.Error(err)
+	}
+	if hello.Negotiated() || hello.Supports(CapabilityChanges) {
+		t.Error("expected minimal hello to report no version or capabilities")
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	for _, version := range []int{0, MinVersion, Version} {
+		if err := CheckVersion(version); err != nil {
+			t.Errorf("expected version %d to be supported, got %v", version, err)
+		}
+	}
+	for _, version := range []int{-1, Version + 1} {
+		if err := CheckVersion(version); err == nil {
+			t.Errorf("expected version %d to be rejected", version)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	op := func(change func(*PatchOperation)) PatchOperation {
+		op := PatchOperation{
+			BaseMessage: BaseMessage{Instance: instance, Epoch: 1},
+			Op:          OpAdd,
+			Value:       FileMetadata{Filename: "file.txt", Size: 1},
+			Sequence:    2,
+		}
+		change(&op)
+		return op
+	}
+
+	tests := []struct {
+		scenario string
+		message  interface{ Validate() error }
+		valid    bool
+	}{
+		{"operation", op(func(*PatchOperation) {}), true},
+		{"operation following a gap", op(func(op *PatchOperation) { op.Previous = 1 }), true},
+		{"bad instance", op(func(op *PatchOperation) { op.Instance = "node" }), false},
+		{"unknown op", op(func(op *PatchOperation) { op.Op = "move" }), false},
+		{"no seqno", op(func(op *PatchOperation) { op.Sequence = 0 }), false},
+		{"prevseqno after seqno", op(func(op *PatchOperation) { op.Previous = 2 }), false},
+		{"no filename", op(func(op *PatchOperation) { op.Value.Filename = "" }), false},
+		{"filename with path", op(func(op *PatchOperation) { op.Value.Filename = "../file.txt" }), false},
+		{"hello", HelloOperation{BaseMessage: BaseMessage{Instance: instance}, Port: 4000}, true},
+		{"hello without port", HelloOperation{BaseMessage: BaseMessage{Instance: instance}}, false},
+		{"hello advertising", HelloOperation{BaseMessage: BaseMessage{Instance: instance}, Advertise: "https://watcher"}, true},
+		{"hello with bad version", HelloOperation{BaseMessage: BaseMessage{Instance: instance}, Port: 4000, Version: -1}, false},
+		{"hello advertising a bad URL", HelloOperation{BaseMessage: BaseMessage{Instance: instance}, Advertise: "watcher:4000"}, false},
+		{"bye", ByeOperation{BaseMessage: BaseMessage{Instance: instance}}, true},
+		{"bye without instance", ByeOperation{}, false},
+		{"listing with bad file", ListResponse{BaseMessage: BaseMessage{Instance: instance}, Files: []FileMetadata{{}}}, false},
+		{"changes out of order", ChangesResponse{
+			BaseMessage: BaseMessage{Instance: instance, Epoch: 1},
+			Operations:  []PatchOperation{op(func(op *PatchOperation) { op.Sequence = 3 }), op(func(*PatchOperation) {})},
+			Sequence:    3,
+		}, false},
+		{"subscribe", SubscribeRequest{Aggregator: "http://127.0.0.1:8000"}, true},
+		{"subscribe without address", SubscribeRequest{}, false},
+	}
+	for _, test := range tests {
+		if err := test.message.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.scenario, test.valid, err)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		op       JSONPatchOperation
+		expected PatchOperation
+		valid    bool
+	}{
+		{
+			JSONPatchOperation{Op: JSONPatchAdd, Path: FilePointer(instance, "a.txt"), Value: &JSONPatchValue{Size: 1, Hash: "aa"}},
+			PatchOperation{BaseMessage: BaseMessage{Instance: instance}, Op: OpAdd, Value: FileMetadata{Filename: "a.txt", Size: 1, Hash: "aa"}},
+			true,
+		},
+		{
+			JSONPatchOperation{Op: JSONPatchReplace, Path: "/" + instance + "/~0a~01.txt", Value: &JSONPatchValue{}, Epoch: 2, Sequence: 4, Previous: 2},
+			PatchOperation{BaseMessage: BaseMessage{Instance: instance, Epoch: 2}, Op: OpModify, Value: FileMetadata{Filename: "~a~1.txt"}, Sequence: 4, Previous: 2},
+			true,
+		},
+		{
+			JSONPatchOperation{Op: JSONPatchRemove, Path: FilePointer(instance, "a.txt")},
+			PatchOperation{BaseMessage: BaseMessage{Instance: instance}, Op: OpRemove, Value: FileMetadata{Filename: "a.txt"}},
+			true,
+		},
+		{JSONPatchOperation{Op: "move", Path: FilePointer(instance, "a.txt")}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchAdd, Path: FilePointer(instance, "a.txt")}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchRemove, Path: FilePointer(instance, "dir/a.txt")}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchRemove, Path: "/" + instance + "/a~2.txt"}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchRemove, Path: "/" + instance}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchRemove, Path: FilePointer("node", "a.txt")}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchRemove, Path: FilePointer(instance, "a.txt"), Previous: 3}, PatchOperation{}, false},
+		{JSONPatchOperation{Op: JSONPatchAdd, Path: FilePointer(instance, "a.txt"), Value: &JSONPatchValue{Size: -1}}, PatchOperation{}, false},
+	}
+	for _, test := range tests {
+		op, err := test.op.PatchOperation()
+		if (err == nil) != test.valid {
+			t.Errorf("%s %s: expected valid %v, got %v", test.op.Op, test.op.Path, test.valid, err)
+			continue
+		}
+		if test.valid && op != test.expected {
+			t.Errorf("%s %s: expected %+v, got %+v", test.op.Op, test.op.Path, test.expected, op)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"instance":"` + instance + `"}`)
+	signature, err := Sign(secret, http.MethodPost, "/bye", body, time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature.Timestamp != 1600000000 || signature.Nonce == "" {
+		t.Errorf("unexpected signature %+v", signature)
+	}
+
+	header := http.Header{}
+	signature.SetHeader(header)
+	parsed, err := SignatureFromHeader(header)
+	if err != nil || parsed != signature {
+		t.Fatalf("expected %+v from header, got %+v %v", signature, parsed, err)
+	}
+	if err := parsed.Verify(secret, http.MethodPost, "/bye", body); err != nil {
+		t.Error(err)
+	}
+
+	tampered := []struct {
+		scenario string
+		secret   []byte
+		path     string
+		body     []byte
+	}{
+		{"wrong secret", []byte("guess"), "/bye", body},
+		{"other endpoint", secret, "/hello", body},
+		{"changed body", secret, "/bye", append(body, ' ')},
+	}
+	for _, test := range tampered {
+		if err := signature.Verify(test.secret, http.MethodPost, test.path, test.body); err == nil {
+			t.Errorf("%s: expected signature not to match", test.scenario)
+		}
+	}
+	if _, err := SignatureFromHeader(http.Header{}); err == nil {
+		t.Error("expected unsigned header to be rejected")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "aggregator", caCert, caKey)
+	issue(t, dir, "node", caCert, caKey)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	serverConfig, err := ServerTLSConfig(file("aggregator.pem"), file("aggregator-key.pem"), file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identity string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = PeerIdentity(r.TLS)
+	}))
+	srv.TLS = serverConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(certFile, keyFile string) error {
+		config, err := ClientTLSConfig(certFile, keyFile, file("ca.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(file("node.pem"), file("node-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if identity != "node" {
+		t.Errorf("expected identity node, got %q", identity)
+	}
+	if err := get("", ""); err != nil {
+		t.Errorf("expected a client without a certificate to connect, got %v", err)
+	}
+	if identity != "" {
+		t.Errorf("expected a client without a certificate to have no identity, got %q", identity)
+	}
+	if PeerIdentity(nil) != "" {
+		t.Error("expected no identity without TLS")
+	}
+	if _, err := ClientTLSConfig("", "", file("node-key.pem")); err == nil {
+		t.Error("expected a file without certificates to be refused as a CA")
+	}
+
+	instance := "56d1a8de-14a8-403b-b3e7-d49307c63553"
+	uri, _ := url.Parse("urn:uuid:56D1A8DE-14A8-403B-B3E7-D49307C63553")
+	cert := &x509.Certificate{URIs: []*url.URL{uri}}
+	if !CertifiesInstance(cert, instance) {
+		t.Errorf("expected certificate naming %s to certify it", uri)
+	}
+	if CertifiesInstance(cert, "2f0d3d7e-5a44-4a8b-9b0c-1f8e8b9a7c11") || CertifiesInstance(&x509.Certificate{}, instance) {
+		t.Error("expected certificates not naming an instance not to certify it")
+	}
+
+	named := &x509.Certificate{Subject: pkix.Name{CommonName: "aggregator"}, DNSNames: []string{"aggregator.example.com"}}
+	if !CertifiesName(named, "aggregator") || !CertifiesName(named, "aggregator.example.com") {
+		t.Error("expected certificate to certify its common and DNS names")
+	}
+	if CertifiesName(named, "node") || CertifiesName(&x509.Certificate{}, "aggregator") {
+		t.Error("expected certificates not naming a name not to certify it")
+	}
+}
+
+// issue writes a certificate for name, signed by parent or self-signed
+// as a certificate authority if parent is nil, and its key to dir.
+func issue(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
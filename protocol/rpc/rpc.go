@@ -0,0 +1,194 @@
+// Package rpc describes the gRPC service watcher nodes can use to talk to
+// the aggregation server over a single stream, rather than making an HTTP
+// request for each message.
+//
+// The service is defined in rpc.proto, from which rpc.pb.go is generated,
+// so any gRPC client can talk to it. Its one method, SyncMethod, is a
+// bidirectional stream on which the node sends Request messages and the
+// aggregator answers each with an Ack. The messages mirror those of
+// package protocol, which this package converts to and from.
+//
+// A request carries the hello, patch or bye it makes as an encoded Message
+// in its Body, encoded once by the node, and that is what is signed, so
+// signatures don't depend on how either side encodes the rest of the
+// request.
+package rpc
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. rpc.proto
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"thirdlight.com/protocol"
+)
+
+// SyncMethod is the full name of the streaming method.
+const SyncMethod = "/protocol.Aggregator/Sync"
+
+// signatureMethod stands in for the HTTP method of a request in the
+// signatures of requests on the stream.
+const signatureMethod = "SYNC"
+
+// NewRequest returns a request carrying message.
+func NewRequest(message *Message) (*Request, error) {
+	body, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Body: body}, nil
+}
+
+// Message decodes the message in the body of the request.
+func (r *Request) Message() (*Message, error) {
+	message := new(Message)
+	if err := proto.Unmarshal(r.Body, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Sign signs the body of the request with the secret shared with the
+// aggregator.
+func (r *Request) Sign(secret []byte, now time.Time) error {
+	signature, err := protocol.Sign(secret, signatureMethod, SyncMethod, r.Body, now)
+	if err != nil {
+		return err
+	}
+	r.Signature = &Signature{Timestamp: signature.Timestamp, Nonce: signature.Nonce, Mac: signature.MAC}
+	return nil
+}
+
+// Verify checks that the request was signed with secret, returning the
+// signature for its timestamp and nonce to be checked.
+func (r *Request) Verify(secret []byte) (protocol.Signature, error) {
+	if r.Signature == nil {
+		return protocol.Signature{}, errors.New("request isn't signed")
+	}
+	signature := protocol.Signature{Timestamp: r.Signature.Timestamp, Nonce: r.Signature.Nonce, MAC: r.Signature.Mac}
+	return signature, signature.Verify(secret, signatureMethod, SyncMethod, r.Body)
+}
+
+// HelloMessage returns a message carrying a hello.
+func HelloMessage(h protocol.HelloOperation) *Message {
+	return &Message{Kind: &Message_Hello{&Hello{
+		Instance:     h.Instance,
+		Epoch:        int64(h.Epoch),
+		Port:         uint32(h.Port),
+		Label:        h.Label,
+		Seqno:        int64(h.Sequence),
+		Advertise:    h.Advertise,
+		Tls:          h.TLS,
+		Version:      int32(h.Version),
+		Capabilities: h.Capabilities,
+	}}}
+}
+
+// Protocol returns the hello as sent over HTTP.
+func (h *Hello) Protocol() protocol.HelloOperation {
+	return protocol.HelloOperation{
+		BaseMessage:  protocol.BaseMessage{Instance: h.GetInstance(), Epoch: int(h.GetEpoch())},
+		Port:         uint(h.GetPort()),
+		Label:        h.GetLabel(),
+		Sequence:     int(h.GetSeqno()),
+		Advertise:    h.GetAdvertise(),
+		TLS:          h.GetTls(),
+		Version:      int(h.GetVersion()),
+		Capabilities: h.GetCapabilities(),
+	}
+}
+
+// ByeMessage returns a message carrying a bye.
+func ByeMessage(b protocol.ByeOperation) *Message {
+	return &Message{Kind: &Message_Bye{&Bye{Instance: b.Instance, Epoch: int64(b.Epoch)}}}
+}
+
+// Protocol returns the bye as sent over HTTP.
+func (b *Bye) Protocol() protocol.ByeOperation {
+	return protocol.ByeOperation{BaseMessage: protocol.BaseMessage{Instance: b.GetInstance(), Epoch: int(b.GetEpoch())}}
+}
+
+// PatchMessage returns a message carrying a set of operations.
+func PatchMessage(ops []protocol.PatchOperation) *Message {
+	patch := &Patch{Operations: make([]*PatchOperation, 0, len(ops))}
+	for _, op := range ops {
+		patch.Operations = append(patch.Operations, &PatchOperation{
+			Instance: op.Instance,
+			Epoch:    int64(op.Epoch),
+			Op:       op.Op,
+			Value: &FileMetadata{
+				Filename: op.Value.Filename,
+				Size:     op.Value.Size,
+				Hash:     op.Value.Hash,
+			},
+			Seqno:     int64(op.Sequence),
+			Prevseqno: int64(op.Previous),
+		})
+	}
+	return &Message{Kind: &Message_Patch{patch}}
+}
+
+// Protocol returns the operations of the patch as sent over HTTP.
+func (p *Patch) Protocol() []protocol.PatchOperation {
+	ops := make([]protocol.PatchOperation, 0, len(p.GetOperations()))
+	for _, op := range p.GetOperations() {
+		ops = append(ops, protocol.PatchOperation{
+			BaseMessage: protocol.BaseMessage{Instance: op.GetInstance(), Epoch: int(op.GetEpoch())},
+			Op:          op.GetOp(),
+			Value: protocol.FileMetadata{
+				Filename: op.GetValue().GetFilename(),
+				Size:     op.GetValue().GetSize(),
+				Hash:     op.GetValue().GetHash(),
+			},
+			Sequence: int(op.GetSeqno()),
+			Previous: int(op.GetPrevseqno()),
+		})
+	}
+	return ops
+}
+
+// NewPatchResponse returns the outcome of a patch to send in an Ack.
+func NewPatchResponse(r protocol.PatchResponse) *PatchResponse {
+	response := &PatchResponse{
+		Results: make([]*PatchResult, 0, len(r.Results)),
+		Nodes:   make([]*NodeSequence, 0, len(r.Nodes)),
+	}
+	for _, result := range r.Results {
+		response.Results = append(response.Results, &PatchResult{
+			Instance: result.Instance,
+			Seqno:    int64(result.Sequence),
+			Status:   result.Status,
+		})
+	}
+	for _, node := range r.Nodes {
+		response.Nodes = append(response.Nodes, &NodeSequence{
+			Instance: node.Instance,
+			Epoch:    int64(node.Epoch),
+			Seqno:    int64(node.Sequence),
+		})
+	}
+	return response
+}
+
+// Protocol returns the outcome of a patch as reported over HTTP.
+func (r *PatchResponse) Protocol() protocol.PatchResponse {
+	response := protocol.PatchResponse{
+		Results: make([]protocol.PatchResult, 0, len(r.GetResults())),
+		Nodes:   make([]protocol.NodeSequence, 0, len(r.GetNodes())),
+	}
+	for _, result := range r.GetResults() {
+		response.Results = append(response.Results, protocol.PatchResult{
+			Instance: result.GetInstance(),
+			Sequence: int(result.GetSeqno()),
+			Status:   result.GetStatus(),
+		})
+	}
+	for _, node := range r.GetNodes() {
+		response.Nodes = append(response.Nodes, protocol.NodeSequence{
+			BaseMessage: protocol.BaseMessage{Instance: node.GetInstance(), Epoch: int(node.GetEpoch())},
+			Sequence:    int(node.GetSeqno()),
+		})
+	}
+	return response
+}
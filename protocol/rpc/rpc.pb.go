@@ -0,0 +1,973 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: rpc.proto
+
+package rpc
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Request is a message sent by a watcher node on the stream.
+type Request struct {
+	// id is chosen by the node, and returned in the Ack to the request.
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// body is an encoded Message, kept as the bytes the node encoded so
+	// that the signature covers exactly them.
+	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	// signature is set when the node and aggregator share a secret.
+	Signature            *Signature `protobuf:"bytes,3,opt,name=signature,proto3" json:"signature,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *Request) Reset()         { *m = Request{} }
+func (m *Request) String() string { return proto.CompactTextString(m) }
+func (*Request) ProtoMessage()    {}
+func (*Request) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{0}
+}
+
+func (m *Request) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Request.Unmarshal(m, b)
+}
+func (m *Request) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Request.Marshal(b, m, deterministic)
+}
+func (m *Request) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Request.Merge(m, src)
+}
+func (m *Request) XXX_Size() int {
+	return xxx_messageInfo_Request.Size(m)
+}
+func (m *Request) XXX_DiscardUnknown() {
+	xxx_messageInfo_Request.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Request proto.InternalMessageInfo
+
+func (m *Request) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+func (m *Request) GetBody() []byte {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *Request) GetSignature() *Signature {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+// Message is the hello, patch or bye a Request carries.
+type Message struct {
+	// Types that are valid to be assigned to Kind:
+	//	*Message_Hello
+	//	*Message_Patch
+	//	*Message_Bye
+	Kind                 isMessage_Kind `protobuf_oneof:"kind"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *Message) Reset()         { *m = Message{} }
+func (m *Message) String() string { return proto.CompactTextString(m) }
+func (*Message) ProtoMessage()    {}
+func (*Message) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{1}
+}
+
+func (m *Message) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Message.Unmarshal(m, b)
+}
+func (m *Message) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Message.Marshal(b, m, deterministic)
+}
+func (m *Message) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Message.Merge(m, src)
+}
+func (m *Message) XXX_Size() int {
+	return xxx_messageInfo_Message.Size(m)
+}
+func (m *Message) XXX_DiscardUnknown() {
+	xxx_messageInfo_Message.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Message proto.InternalMessageInfo
+
+type isMessage_Kind interface {
+	isMessage_Kind()
+}
+
+type Message_Hello struct {
+	Hello *Hello `protobuf:"bytes,1,opt,name=hello,proto3,oneof"`
+}
+
+type Message_Patch struct {
+	Patch *Patch `protobuf:"bytes,2,opt,name=patch,proto3,oneof"`
+}
+
+type Message_Bye struct {
+	Bye *Bye `protobuf:"bytes,3,opt,name=bye,proto3,oneof"`
+}
+
+func (*Message_Hello) isMessage_Kind() {}
+
+func (*Message_Patch) isMessage_Kind() {}
+
+func (*Message_Bye) isMessage_Kind() {}
+
+func (m *Message) GetKind() isMessage_Kind {
+	if m != nil {
+		return m.Kind
+	}
+	return nil
+}
+
+func (m *Message) GetHello() *Hello {
+	if x, ok := m.GetKind().(*Message_Hello); ok {
+		return x.Hello
+	}
+	return nil
+}
+
+func (m *Message) GetPatch() *Patch {
+	if x, ok := m.GetKind().(*Message_Patch); ok {
+		return x.Patch
+	}
+	return nil
+}
+
+func (m *Message) GetBye() *Bye {
+	if x, ok := m.GetKind().(*Message_Bye); ok {
+		return x.Bye
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*Message) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*Message_Hello)(nil),
+		(*Message_Patch)(nil),
+		(*Message_Bye)(nil),
+	}
+}
+
+// Signature shows a request was made by a holder of the shared secret.
+type Signature struct {
+	Timestamp            int64    `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Nonce                string   `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Mac                  string   `protobuf:"bytes,3,opt,name=mac,proto3" json:"mac,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Signature) Reset()         { *m = Signature{} }
+func (m *Signature) String() string { return proto.CompactTextString(m) }
+func (*Signature) ProtoMessage()    {}
+func (*Signature) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{2}
+}
+
+func (m *Signature) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Signature.Unmarshal(m, b)
+}
+func (m *Signature) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Signature.Marshal(b, m, deterministic)
+}
+func (m *Signature) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Signature.Merge(m, src)
+}
+func (m *Signature) XXX_Size() int {
+	return xxx_messageInfo_Signature.Size(m)
+}
+func (m *Signature) XXX_DiscardUnknown() {
+	xxx_messageInfo_Signature.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Signature proto.InternalMessageInfo
+
+func (m *Signature) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *Signature) GetNonce() string {
+	if m != nil {
+		return m.Nonce
+	}
+	return ""
+}
+
+func (m *Signature) GetMac() string {
+	if m != nil {
+		return m.Mac
+	}
+	return ""
+}
+
+// Hello registers a watched directory with the aggregator.
+type Hello struct {
+	Instance             string   `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	Epoch                int64    `protobuf:"varint,2,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	Port                 uint32   `protobuf:"varint,3,opt,name=port,proto3" json:"port,omitempty"`
+	Label                string   `protobuf:"bytes,4,opt,name=label,proto3" json:"label,omitempty"`
+	Seqno                int64    `protobuf:"varint,5,opt,name=seqno,proto3" json:"seqno,omitempty"`
+	Advertise            string   `protobuf:"bytes,6,opt,name=advertise,proto3" json:"advertise,omitempty"`
+	Tls                  bool     `protobuf:"varint,7,opt,name=tls,proto3" json:"tls,omitempty"`
+	Version              int32    `protobuf:"varint,8,opt,name=version,proto3" json:"version,omitempty"`
+	Capabilities         []string `protobuf:"bytes,9,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+func (*Hello) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{3}
+}
+
+func (m *Hello) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Hello.Unmarshal(m, b)
+}
+func (m *Hello) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Hello.Marshal(b, m, deterministic)
+}
+func (m *Hello) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Hello.Merge(m, src)
+}
+func (m *Hello) XXX_Size() int {
+	return xxx_messageInfo_Hello.Size(m)
+}
+func (m *Hello) XXX_DiscardUnknown() {
+	xxx_messageInfo_Hello.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Hello proto.InternalMessageInfo
+
+func (m *Hello) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *Hello) GetEpoch() int64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+func (m *Hello) GetPort() uint32 {
+	if m != nil {
+		return m.Port
+	}
+	return 0
+}
+
+func (m *Hello) GetLabel() string {
+	if m != nil {
+		return m.Label
+	}
+	return ""
+}
+
+func (m *Hello) GetSeqno() int64 {
+	if m != nil {
+		return m.Seqno
+	}
+	return 0
+}
+
+func (m *Hello) GetAdvertise() string {
+	if m != nil {
+		return m.Advertise
+	}
+	return ""
+}
+
+func (m *Hello) GetTls() bool {
+	if m != nil {
+		return m.Tls
+	}
+	return false
+}
+
+func (m *Hello) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Hello) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+// Bye unregisters a watched directory from the aggregator.
+type Bye struct {
+	Instance             string   `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	Epoch                int64    `protobuf:"varint,2,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Bye) Reset()         { *m = Bye{} }
+func (m *Bye) String() string { return proto.CompactTextString(m) }
+func (*Bye) ProtoMessage()    {}
+func (*Bye) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{4}
+}
+
+func (m *Bye) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Bye.Unmarshal(m, b)
+}
+func (m *Bye) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Bye.Marshal(b, m, deterministic)
+}
+func (m *Bye) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Bye.Merge(m, src)
+}
+func (m *Bye) XXX_Size() int {
+	return xxx_messageInfo_Bye.Size(m)
+}
+func (m *Bye) XXX_DiscardUnknown() {
+	xxx_messageInfo_Bye.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Bye proto.InternalMessageInfo
+
+func (m *Bye) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *Bye) GetEpoch() int64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+// Patch is a set of changes to watched directories.
+type Patch struct {
+	Operations           []*PatchOperation `protobuf:"bytes,1,rep,name=operations,proto3" json:"operations,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *Patch) Reset()         { *m = Patch{} }
+func (m *Patch) String() string { return proto.CompactTextString(m) }
+func (*Patch) ProtoMessage()    {}
+func (*Patch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{5}
+}
+
+func (m *Patch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Patch.Unmarshal(m, b)
+}
+func (m *Patch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Patch.Marshal(b, m, deterministic)
+}
+func (m *Patch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Patch.Merge(m, src)
+}
+func (m *Patch) XXX_Size() int {
+	return xxx_messageInfo_Patch.Size(m)
+}
+func (m *Patch) XXX_DiscardUnknown() {
+	xxx_messageInfo_Patch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Patch proto.InternalMessageInfo
+
+func (m *Patch) GetOperations() []*PatchOperation {
+	if m != nil {
+		return m.Operations
+	}
+	return nil
+}
+
+// PatchOperation is a single change to a watched directory.
+type PatchOperation struct {
+	Instance             string        `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	Epoch                int64         `protobuf:"varint,2,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	Op                   string        `protobuf:"bytes,3,opt,name=op,proto3" json:"op,omitempty"`
+	Value                *FileMetadata `protobuf:"bytes,4,opt,name=value,proto3" json:"value,omitempty"`
+	Seqno                int64         `protobuf:"varint,5,opt,name=seqno,proto3" json:"seqno,omitempty"`
+	Prevseqno            int64         `protobuf:"varint,6,opt,name=prevseqno,proto3" json:"prevseqno,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *PatchOperation) Reset()         { *m = PatchOperation{} }
+func (m *PatchOperation) String() string { return proto.CompactTextString(m) }
+func (*PatchOperation) ProtoMessage()    {}
+func (*PatchOperation) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{6}
+}
+
+func (m *PatchOperation) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PatchOperation.Unmarshal(m, b)
+}
+func (m *PatchOperation) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PatchOperation.Marshal(b, m, deterministic)
+}
+func (m *PatchOperation) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PatchOperation.Merge(m, src)
+}
+func (m *PatchOperation) XXX_Size() int {
+	return xxx_messageInfo_PatchOperation.Size(m)
+}
+func (m *PatchOperation) XXX_DiscardUnknown() {
+	xxx_messageInfo_PatchOperation.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PatchOperation proto.InternalMessageInfo
+
+func (m *PatchOperation) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *PatchOperation) GetEpoch() int64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+func (m *PatchOperation) GetOp() string {
+	if m != nil {
+		return m.Op
+	}
+	return ""
+}
+
+func (m *PatchOperation) GetValue() *FileMetadata {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *PatchOperation) GetSeqno() int64 {
+	if m != nil {
+		return m.Seqno
+	}
+	return 0
+}
+
+func (m *PatchOperation) GetPrevseqno() int64 {
+	if m != nil {
+		return m.Prevseqno
+	}
+	return 0
+}
+
+// FileMetadata describes a single file in a watched directory.
+type FileMetadata struct {
+	Filename             string   `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Size                 int64    `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	Hash                 string   `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FileMetadata) Reset()         { *m = FileMetadata{} }
+func (m *FileMetadata) String() string { return proto.CompactTextString(m) }
+func (*FileMetadata) ProtoMessage()    {}
+func (*FileMetadata) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{7}
+}
+
+func (m *FileMetadata) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FileMetadata.Unmarshal(m, b)
+}
+func (m *FileMetadata) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FileMetadata.Marshal(b, m, deterministic)
+}
+func (m *FileMetadata) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FileMetadata.Merge(m, src)
+}
+func (m *FileMetadata) XXX_Size() int {
+	return xxx_messageInfo_FileMetadata.Size(m)
+}
+func (m *FileMetadata) XXX_DiscardUnknown() {
+	xxx_messageInfo_FileMetadata.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FileMetadata proto.InternalMessageInfo
+
+func (m *FileMetadata) GetFilename() string {
+	if m != nil {
+		return m.Filename
+	}
+	return ""
+}
+
+func (m *FileMetadata) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *FileMetadata) GetHash() string {
+	if m != nil {
+		return m.Hash
+	}
+	return ""
+}
+
+// Ack is the aggregator's reply to a Request.
+type Ack struct {
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// code is the HTTP status the request would have been answered with
+	// over HTTP, and error the reason it failed, if it did.
+	Code  int32  `protobuf:"varint,2,opt,name=code,proto3" json:"code,omitempty"`
+	Error string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	// patch holds the outcome of a patch's operations.
+	Patch                *PatchResponse `protobuf:"bytes,4,opt,name=patch,proto3" json:"patch,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *Ack) Reset()         { *m = Ack{} }
+func (m *Ack) String() string { return proto.CompactTextString(m) }
+func (*Ack) ProtoMessage()    {}
+func (*Ack) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{8}
+}
+
+func (m *Ack) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Ack.Unmarshal(m, b)
+}
+func (m *Ack) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Ack.Marshal(b, m, deterministic)
+}
+func (m *Ack) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Ack.Merge(m, src)
+}
+func (m *Ack) XXX_Size() int {
+	return xxx_messageInfo_Ack.Size(m)
+}
+func (m *Ack) XXX_DiscardUnknown() {
+	xxx_messageInfo_Ack.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Ack proto.InternalMessageInfo
+
+func (m *Ack) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+func (m *Ack) GetCode() int32 {
+	if m != nil {
+		return m.Code
+	}
+	return 0
+}
+
+func (m *Ack) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *Ack) GetPatch() *PatchResponse {
+	if m != nil {
+		return m.Patch
+	}
+	return nil
+}
+
+// PatchResponse is the outcome of a Patch.
+type PatchResponse struct {
+	Results              []*PatchResult  `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	Nodes                []*NodeSequence `protobuf:"bytes,2,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *PatchResponse) Reset()         { *m = PatchResponse{} }
+func (m *PatchResponse) String() string { return proto.CompactTextString(m) }
+func (*PatchResponse) ProtoMessage()    {}
+func (*PatchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{9}
+}
+
+func (m *PatchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PatchResponse.Unmarshal(m, b)
+}
+func (m *PatchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PatchResponse.Marshal(b, m, deterministic)
+}
+func (m *PatchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PatchResponse.Merge(m, src)
+}
+func (m *PatchResponse) XXX_Size() int {
+	return xxx_messageInfo_PatchResponse.Size(m)
+}
+func (m *PatchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_PatchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PatchResponse proto.InternalMessageInfo
+
+func (m *PatchResponse) GetResults() []*PatchResult {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
+func (m *PatchResponse) GetNodes() []*NodeSequence {
+	if m != nil {
+		return m.Nodes
+	}
+	return nil
+}
+
+// PatchResult is the outcome of a single operation.
+type PatchResult struct {
+	Instance             string   `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	Seqno                int64    `protobuf:"varint,2,opt,name=seqno,proto3" json:"seqno,omitempty"`
+	Status               string   `protobuf:"bytes,3,opt,name=status,proto3" json:"status,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PatchResult) Reset()         { *m = PatchResult{} }
+func (m *PatchResult) String() string { return proto.CompactTextString(m) }
+func (*PatchResult) ProtoMessage()    {}
+func (*PatchResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{10}
+}
+
+func (m *PatchResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PatchResult.Unmarshal(m, b)
+}
+func (m *PatchResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PatchResult.Marshal(b, m, deterministic)
+}
+func (m *PatchResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PatchResult.Merge(m, src)
+}
+func (m *PatchResult) XXX_Size() int {
+	return xxx_messageInfo_PatchResult.Size(m)
+}
+func (m *PatchResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_PatchResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PatchResult proto.InternalMessageInfo
+
+func (m *PatchResult) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *PatchResult) GetSeqno() int64 {
+	if m != nil {
+		return m.Seqno
+	}
+	return 0
+}
+
+func (m *PatchResult) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+// NodeSequence is the highest sequence number the aggregator has
+// applied for an instance without a gap.
+type NodeSequence struct {
+	Instance             string   `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	Epoch                int64    `protobuf:"varint,2,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	Seqno                int64    `protobuf:"varint,3,opt,name=seqno,proto3" json:"seqno,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *NodeSequence) Reset()         { *m = NodeSequence{} }
+func (m *NodeSequence) String() string { return proto.CompactTextString(m) }
+func (*NodeSequence) ProtoMessage()    {}
+func (*NodeSequence) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{11}
+}
+
+func (m *NodeSequence) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_NodeSequence.Unmarshal(m, b)
+}
+func (m *NodeSequence) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_NodeSequence.Marshal(b, m, deterministic)
+}
+func (m *NodeSequence) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_NodeSequence.Merge(m, src)
+}
+func (m *NodeSequence) XXX_Size() int {
+	return xxx_messageInfo_NodeSequence.Size(m)
+}
+func (m *NodeSequence) XXX_DiscardUnknown() {
+	xxx_messageInfo_NodeSequence.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_NodeSequence proto.InternalMessageInfo
+
+func (m *NodeSequence) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *NodeSequence) GetEpoch() int64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+func (m *NodeSequence) GetSeqno() int64 {
+	if m != nil {
+		return m.Seqno
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*Request)(nil), "protocol.Request")
+	proto.RegisterType((*Message)(nil), "protocol.Message")
+	proto.RegisterType((*Signature)(nil), "protocol.Signature")
+	proto.RegisterType((*Hello)(nil), "protocol.Hello")
+	proto.RegisterType((*Bye)(nil), "protocol.Bye")
+	proto.RegisterType((*Patch)(nil), "protocol.Patch")
+	proto.RegisterType((*PatchOperation)(nil), "protocol.PatchOperation")
+	proto.RegisterType((*FileMetadata)(nil), "protocol.FileMetadata")
+	proto.RegisterType((*Ack)(nil), "protocol.Ack")
+	proto.RegisterType((*PatchResponse)(nil), "protocol.PatchResponse")
+	proto.RegisterType((*PatchResult)(nil), "protocol.PatchResult")
+	proto.RegisterType((*NodeSequence)(nil), "protocol.NodeSequence")
+}
+
+func init() { proto.RegisterFile("rpc.proto", fileDescriptor_77a6da22d6a3feb1) }
+
+var fileDescriptor_77a6da22d6a3feb1 = []byte{
+	// 674 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0xcd, 0x6e, 0xd3, 0x40,
+	0x10, 0xae, 0xed, 0x38, 0x89, 0x27, 0x69, 0x81, 0x05, 0x8a, 0x55, 0x21, 0xe1, 0xfa, 0x82, 0x0f,
+	0x25, 0x85, 0x70, 0x00, 0xc1, 0x29, 0x39, 0xa0, 0x5e, 0xca, 0xcf, 0x56, 0x02, 0x89, 0x13, 0x1b,
+	0x7b, 0x48, 0x56, 0x75, 0xbc, 0xee, 0xee, 0x26, 0x52, 0x78, 0x00, 0x9e, 0x88, 0x77, 0xe2, 0x35,
+	0xd0, 0xae, 0xed, 0xfc, 0x14, 0x10, 0xa2, 0x27, 0xcf, 0x7c, 0xf3, 0xed, 0xcc, 0x37, 0x33, 0xde,
+	0x85, 0x40, 0x96, 0xe9, 0xa0, 0x94, 0x42, 0x0b, 0xd2, 0xb5, 0x9f, 0x54, 0xe4, 0xf1, 0x17, 0xe8,
+	0x50, 0xbc, 0x5a, 0xa0, 0xd2, 0xe4, 0x00, 0x5c, 0x9e, 0x85, 0x4e, 0xe4, 0x24, 0x2d, 0xea, 0xf2,
+	0x8c, 0x10, 0x68, 0x4d, 0x44, 0xb6, 0x0a, 0xdd, 0xc8, 0x49, 0xfa, 0xd4, 0xda, 0xe4, 0x19, 0x04,
+	0x8a, 0x4f, 0x0b, 0xa6, 0x17, 0x12, 0x43, 0x2f, 0x72, 0x92, 0xde, 0xf0, 0xee, 0xa0, 0x49, 0x36,
+	0xb8, 0x68, 0x42, 0x74, 0xc3, 0x8a, 0xbf, 0x3b, 0xd0, 0x39, 0x47, 0xa5, 0xd8, 0x14, 0xc9, 0x63,
+	0xf0, 0x67, 0x98, 0xe7, 0xc2, 0x56, 0xe9, 0x0d, 0x6f, 0x6d, 0x8e, 0x9e, 0x19, 0xf8, 0x6c, 0x8f,
+	0x56, 0x71, 0x43, 0x2c, 0x99, 0x4e, 0x67, 0xa1, 0x7b, 0x9d, 0xf8, 0xde, 0xc0, 0x86, 0x68, 0xe3,
+	0xe4, 0x18, 0xbc, 0xc9, 0xaa, 0x91, 0xb2, 0xbf, 0xa1, 0x8d, 0x57, 0x78, 0xb6, 0x47, 0x4d, 0x6c,
+	0xdc, 0x86, 0xd6, 0x25, 0x2f, 0xb2, 0xf8, 0x03, 0x04, 0x6b, 0x81, 0xe4, 0x21, 0x04, 0x9a, 0xcf,
+	0x51, 0x69, 0x36, 0x2f, 0xad, 0x1a, 0x8f, 0x6e, 0x00, 0x72, 0x0f, 0xfc, 0x42, 0x14, 0x29, 0xda,
+	0xf2, 0x01, 0xad, 0x1c, 0x72, 0x1b, 0xbc, 0x39, 0x4b, 0x6d, 0xad, 0x80, 0x1a, 0x33, 0xfe, 0xe9,
+	0x80, 0x6f, 0x95, 0x93, 0x23, 0xe8, 0xf2, 0x42, 0x69, 0x66, 0x0e, 0x39, 0x96, 0xb0, 0xf6, 0x4d,
+	0x36, 0x2c, 0x45, 0xdd, 0x8c, 0x47, 0x2b, 0xc7, 0x8c, 0xb7, 0x14, 0x52, 0xdb, 0x74, 0xfb, 0xd4,
+	0xda, 0x86, 0x99, 0xb3, 0x09, 0xe6, 0x61, 0xab, 0xaa, 0x6b, 0x1d, 0x83, 0x2a, 0xbc, 0x2a, 0x44,
+	0xe8, 0x57, 0xe7, 0xad, 0x63, 0x3a, 0x60, 0xd9, 0x12, 0xa5, 0xe6, 0x0a, 0xc3, 0xb6, 0xe5, 0x6f,
+	0x00, 0xa3, 0x55, 0xe7, 0x2a, 0xec, 0x44, 0x4e, 0xd2, 0xa5, 0xc6, 0x24, 0x21, 0x74, 0x96, 0x28,
+	0x15, 0x17, 0x45, 0xd8, 0x8d, 0x9c, 0xc4, 0xa7, 0x8d, 0x4b, 0x62, 0xe8, 0xa7, 0xac, 0x64, 0x13,
+	0x9e, 0x73, 0xcd, 0x51, 0x85, 0x41, 0xe4, 0x25, 0x01, 0xdd, 0xc1, 0xe2, 0x17, 0xe0, 0x8d, 0x57,
+	0xf8, 0xff, 0x6d, 0xc6, 0x23, 0xf0, 0xed, 0xca, 0xc8, 0x4b, 0x00, 0x51, 0xa2, 0x64, 0x9a, 0x8b,
+	0x42, 0x85, 0x4e, 0xe4, 0x25, 0xbd, 0x61, 0x78, 0x6d, 0xaf, 0xef, 0x1a, 0x02, 0xdd, 0xe2, 0xc6,
+	0x3f, 0x1c, 0x38, 0xd8, 0x0d, 0xdf, 0x60, 0xdc, 0x07, 0xe0, 0x8a, 0xb2, 0xde, 0x9d, 0x2b, 0x4a,
+	0x72, 0x02, 0xfe, 0x92, 0xe5, 0x0b, 0xb4, 0xa3, 0xee, 0x0d, 0x0f, 0x37, 0x4a, 0xde, 0xf0, 0x1c,
+	0xcf, 0x51, 0xb3, 0x8c, 0x69, 0x46, 0x2b, 0xd2, 0xdf, 0x57, 0x50, 0x4a, 0x5c, 0x56, 0x91, 0x76,
+	0xf5, 0x13, 0xad, 0x81, 0x98, 0x42, 0x7f, 0x3b, 0x95, 0xd1, 0xfc, 0x95, 0xe7, 0x58, 0xb0, 0xf9,
+	0x5a, 0x73, 0xe3, 0x9b, 0x9f, 0x41, 0xf1, 0x6f, 0x58, 0x4b, 0xb6, 0xb6, 0xc1, 0x66, 0x4c, 0xcd,
+	0x6a, 0xcd, 0xd6, 0x8e, 0x0b, 0xf0, 0x46, 0xe9, 0xe5, 0x9f, 0xae, 0x6a, 0x2a, 0xb2, 0xea, 0xb8,
+	0x4f, 0xad, 0x6d, 0xc7, 0x20, 0xa5, 0x90, 0xf5, 0xf9, 0xca, 0x21, 0x4f, 0x9a, 0x8b, 0x55, 0xb5,
+	0xfd, 0xe0, 0xda, 0x02, 0x28, 0xaa, 0x52, 0x14, 0x0a, 0xeb, 0xeb, 0x15, 0x17, 0xb0, 0xbf, 0x83,
+	0x93, 0x53, 0xe8, 0x48, 0x54, 0x8b, 0x5c, 0x37, 0x2b, 0xbc, 0xff, 0x7b, 0x86, 0x45, 0xae, 0x69,
+	0xc3, 0x32, 0x73, 0x2e, 0x44, 0x86, 0x2a, 0x74, 0x23, 0x6f, 0x77, 0xce, 0x6f, 0x45, 0x86, 0x17,
+	0xe6, 0xed, 0x29, 0x52, 0xa4, 0x15, 0x29, 0xfe, 0x04, 0xbd, 0xad, 0x2c, 0xff, 0x5a, 0x73, 0x35,
+	0x78, 0x77, 0x7b, 0x25, 0x87, 0xd0, 0x56, 0x9a, 0xe9, 0x85, 0xaa, 0xdb, 0xae, 0xbd, 0xf8, 0x23,
+	0xf4, 0xb7, 0xeb, 0xdd, 0xe0, 0x07, 0x5a, 0xd7, 0xf3, 0xb6, 0xea, 0x0d, 0x5f, 0x01, 0x8c, 0xa6,
+	0x53, 0x89, 0x53, 0xa6, 0x85, 0x24, 0x27, 0xd0, 0xba, 0x58, 0x15, 0x29, 0xb9, 0xb3, 0xe9, 0xb2,
+	0x7e, 0x5d, 0x8f, 0xb6, 0xde, 0xa6, 0x51, 0x7a, 0x99, 0x38, 0x4f, 0x9d, 0xf1, 0xf1, 0xe7, 0x47,
+	0x7a, 0xc6, 0x65, 0x96, 0xf3, 0xe9, 0x4c, 0x0f, 0x52, 0x31, 0x3f, 0x6d, 0x28, 0xa7, 0xb2, 0x4c,
+	0x5f, 0xcb, 0x32, 0x9d, 0xb4, 0x2d, 0xf2, 0xfc, 0xd7, 0x00, 0xbf, 0x96, 0x2e, 0x7f, 0xbc, 0x05,
+	0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// AggregatorClient is the client API for Aggregator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type AggregatorClient interface {
+	// Sync carries a node's requests to the aggregator, which answers
+	// each with an Ack, in the order they arrive.
+	Sync(ctx context.Context, opts ...grpc.CallOption) (Aggregator_SyncClient, error)
+}
+
+type aggregatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAggregatorClient(cc grpc.ClientConnInterface) AggregatorClient {
+	return &aggregatorClient{cc}
+}
+
+func (c *aggregatorClient) Sync(ctx context.Context, opts ...grpc.CallOption) (Aggregator_SyncClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Aggregator_serviceDesc.Streams[0], "/protocol.Aggregator/Sync", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &aggregatorSyncClient{stream}
+	return x, nil
+}
+
+type Aggregator_SyncClient interface {
+	Send(*Request) error
+	Recv() (*Ack, error)
+	grpc.ClientStream
+}
+
+type aggregatorSyncClient struct {
+	grpc.ClientStream
+}
+
+func (x *aggregatorSyncClient) Send(m *Request) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *aggregatorSyncClient) Recv() (*Ack, error) {
+	m := new(Ack)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AggregatorServer is the server API for Aggregator service.
+type AggregatorServer interface {
+	// Sync carries a node's requests to the aggregator, which answers
+	// each with an Ack, in the order they arrive.
+	Sync(Aggregator_SyncServer) error
+}
+
+// UnimplementedAggregatorServer can be embedded to have forward compatible implementations.
+type UnimplementedAggregatorServer struct {
+}
+
+func (*UnimplementedAggregatorServer) Sync(srv Aggregator_SyncServer) error {
+	return status.Errorf(codes.Unimplemented, "method Sync not implemented")
+}
+
+func RegisterAggregatorServer(s *grpc.Server, srv AggregatorServer) {
+	s.RegisterService(&_Aggregator_serviceDesc, srv)
+}
+
+func _Aggregator_Sync_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AggregatorServer).Sync(&aggregatorSyncServer{stream})
+}
+
+type Aggregator_SyncServer interface {
+	Send(*Ack) error
+	Recv() (*Request, error)
+	grpc.ServerStream
+}
+
+type aggregatorSyncServer struct {
+	grpc.ServerStream
+}
+
+func (x *aggregatorSyncServer) Send(m *Ack) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *aggregatorSyncServer) Recv() (*Request, error) {
+	m := new(Request)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Aggregator_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "protocol.Aggregator",
+	HandlerType: (*AggregatorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Sync",
+			Handler:       _Aggregator_Sync_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "rpc.proto",
+}
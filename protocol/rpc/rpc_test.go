@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"thirdlight.com/protocol"
+)
+
+const instance = "56d1a8de-14a8-403b-b3e7-d49307c63553"
+
+// TestMessages checks that each message comes out of a request on the
+// stream as it went in.
+func TestMessages(t *testing.T) {
+	base := protocol.BaseMessage{Instance: instance, Epoch: 2}
+	hello := protocol.HelloOperation{
+		BaseMessage:  base,
+		Port:         4001,
+		Label:        "docs",
+		Sequence:     12,
+		Advertise:    "http://watcher.example.com:4001",
+		TLS:          true,
+		Version:      protocol.Version,
+		Capabilities: protocol.Capabilities,
+	}
+	ops := []protocol.PatchOperation{
+		{BaseMessage: base, Op: protocol.OpAdd, Value: protocol.FileMetadata{Filename: "badger.png", Size: 2048, Hash: "9f86d081"}, Sequence: 3},
+		{BaseMessage: base, Op: protocol.OpRemove, Value: protocol.FileMetadata{Filename: "fish.jpg"}, Sequence: 6, Previous: 3},
+	}
+	bye := protocol.ByeOperation{BaseMessage: base}
+
+	tests := []struct {
+		message *Message
+		decode  func(*Message) interface{}
+		sent    interface{}
+	}{
+		{HelloMessage(hello), func(m *Message) interface{} { return m.GetHello().Protocol() }, hello},
+		{PatchMessage(ops), func(m *Message) interface{} { return m.GetPatch().Protocol() }, ops},
+		{ByeMessage(bye), func(m *Message) interface{} { return m.GetBye().Protocol() }, bye},
+	}
+	for _, test := range tests {
+		request, err := NewRequest(test.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := request.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received := test.decode(message); !reflect.DeepEqual(received, test.sent) {
+			t.Errorf("expected %+v, got %+v", test.sent, received)
+		}
+	}
+
+	response := protocol.PatchResponse{
+		Results: []protocol.PatchResult{{Instance: instance, Sequence: 3, Status: protocol.StatusApplied}},
+		Nodes:   []protocol.NodeSequence{{BaseMessage: base, Sequence: 3}},
+	}
+	if received := NewPatchResponse(response).Protocol(); !reflect.DeepEqual(received, response) {
+		t.Errorf("expected %+v, got %+v", response, received)
+	}
+}
+
+// TestSignature checks that a signature covers the body of a request.
+func TestSignature(t *testing.T) {
+	secret := []byte("secret")
+	request, err := NewRequest(ByeMessage(protocol.ByeOperation{BaseMessage: protocol.BaseMessage{Instance: instance}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request.Verify(secret); err == nil {
+		t.Error("expected unsigned request to be refused")
+	}
+	if err := request.Sign(secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request.Verify(secret); err != nil {
+		t.Errorf("expected signed request to be verified, got %v", err)
+	}
+	if _, err := request.Verify([]byte("guess")); err == nil {
+		t.Error("expected request signed with another secret to be refused")
+	}
+	tampered, err := NewRequest(HelloMessage(protocol.HelloOperation{BaseMessage: protocol.BaseMessage{Instance: instance}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Signature = request.Signature
+	if _, err := tampered.Verify(secret); err == nil {
+		t.Error("expected request with another body than signed to be refused")
+	}
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The headers of an HTTP request signed with a shared secret.
+const (
+	HeaderTimestamp = "X-Signature-Timestamp"
+	HeaderNonce     = "X-Signature-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+// DefaultSignatureWindow is how far the time a request was signed may
+// be from the clock of the service receiving it, by default.
+const DefaultSignatureWindow = 5 * time.Minute
+
+// Signature shows a request was made by a holder of the secret shared
+// by watcher nodes and the aggregator, at Timestamp. Nonce is unique to
+// the request, so that it can't be replayed.
+type Signature struct {
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	MAC       string `json:"mac"`
+}
+
+// Sign returns the signature of a request with body to path, made now.
+func Sign(secret []byte, method, path string, body []byte, now time.Time) (Signature, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return Signature{}, err
+	}
+	s := Signature{
+		Timestamp: now.Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	s.MAC = hex.EncodeToString(s.mac(secret, method, path, body))
+	return s, nil
+}
+
+// Verify checks that the signature was made with secret for the request.
+// Whether its timestamp and nonce are acceptable is up to the caller.
+func (s Signature) Verify(secret []byte, method, path string, body []byte) error {
+	mac, err := hex.DecodeString(s.MAC)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	if !hmac.Equal(mac, s.mac(secret, method, path, body)) {
+		return errors.New("signature doesn't match")
+	}
+	return nil
+}
+
+// CheckTime refuses a signature made more than window either side of now.
+func (s Signature) CheckTime(now time.Time, window time.Duration) error {
+	signed := time.Unix(s.Timestamp, 0)
+	if signed.Before(now.Add(-window)) || signed.After(now.Add(window)) {
+		return fmt.Errorf("request signed at %s, more than %s from now", signed.UTC().Format(time.RFC3339), window)
+	}
+	return nil
+}
+
+// mac is the HMAC-SHA256 of the request, its timestamp and nonce.
+func (s Signature) mac(secret []byte, method, path string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s\n", method, path, s.Timestamp, s.Nonce)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// SetHeader adds the signature to the headers of an HTTP request.
+func (s Signature) SetHeader(header http.Header) {
+	header.Set(HeaderTimestamp, strconv.FormatInt(s.Timestamp, 10))
+	header.Set(HeaderNonce, s.Nonce)
+	header.Set(HeaderSignature, s.MAC)
+}
+
+// SignatureFromHeader returns the signature in the headers of an HTTP
+// request.
+func SignatureFromHeader(header http.Header) (Signature, error) {
+	if header.Get(HeaderSignature) == "" {
+		return Signature{}, errors.New("request isn't signed")
+	}
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return Signature{}, errors.New("malformed signature timestamp")
+	}
+	s := Signature{
+		Timestamp: timestamp,
+		Nonce:     header.Get(HeaderNonce),
+		MAC:       header.Get(HeaderSignature),
+	}
+	if s.Nonce == "" {
+		return Signature{}, errors.New("missing signature nonce")
+	}
+	return s, nil
+}
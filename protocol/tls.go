@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ServerTLSConfig returns the configuration of a server with the
+// certificate and key in the PEM files certFile and keyFile. If caFile
+// is set, certificates clients present must be signed by one of the
+// certificate authorities in it. Clients may still connect without one,
+// so servers can allow some requests from them, such as reads.
+func ServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientTLSConfig returns the configuration of a client presenting the
+// certificate and key in certFile and keyFile, if set, to servers whose
+// certificates are signed by a certificate authority in caFile, or the
+// system's if caFile isn't set.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// PeerCertificate returns the verified certificate the peer of a TLS
+// connection presented, or nil if it presented none.
+func PeerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// PeerIdentity returns the common name of the verified certificate the
+// peer of a TLS connection presented, or "" if it presented none.
+func PeerIdentity(state *tls.ConnectionState) string {
+	if cert := PeerCertificate(state); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// CertifiesName returns true if a certificate is for name, as its common
+// name or one of its DNS subject alternative names.
+func CertifiesName(cert *x509.Certificate, name string) bool {
+	return cert.Subject.CommonName == name || cert.VerifyHostname(name) == nil
+}
+
+// InstanceURI returns the URI that names an instance among the subject
+// alternative names of a certificate, binding the instance to the nodes
+// that present it.
+func InstanceURI(instance string) string {
+	return "urn:uuid:" + strings.ToLower(instance)
+}
+
+// CertifiesInstance returns true if a certificate names instance among
+// its subject alternative names, as InstanceURI makes it.
+func CertifiesInstance(cert *x509.Certificate, instance string) bool {
+	name := InstanceURI(instance)
+	for _, uri := range cert.URIs {
+		if strings.ToLower(uri.String()) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -9,61 +9,224 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
-	"thirdlight.com/watcher-node/lib"
+	"thirdlight.com/protocol"
 )
 
 type Aggregator struct {
-	baseUrl *url.URL
-	client  *http.Client
+	mutex sync.RWMutex
+	// transport carries messages to the aggregator, and is nil
+	// until its address is known. dial makes one for an address.
+	transport transport
+	dial      func(addr string) (transport, error)
+	// advertise is the base URL sent in hellos for the
+	// aggregator to reach the node at, if set.
+	advertise string
+	// tls is set when the node serves its files over https.
+	tls bool
 }
 
-func New(client *http.Client, addr string) (*Aggregator, error) {
-	if addr == "" {
-		return nil, errors.New("no aggregation server address provided")
+// transport carries messages to the aggregator by some means.
+type transport interface {
+	hello(protocol.HelloOperation) error
+	bye(protocol.ByeOperation) error
+	// patch decodes any results the aggregator reports into response,
+	// whether or not it returns an error.
+	patch(ops []protocol.PatchOperation, response *protocol.PatchResponse) error
+	close()
+}
+
+// New returns a client for the aggregator at addr. If advertise is set,
+// the aggregator is told to reach the node at that base URL rather than
+// the address its requests come from. addr may be empty when the node
+// is only polled, until an aggregator subscribes with SetAddress. If
+// secret isn't nil, requests are signed with it.
+func New(client *http.Client, addr string, advertise string, secret []byte) (*Aggregator, error) {
+	return newAggregator(func(addr string) (transport, error) {
+		t, err := newHTTPTransport(client, addr, secret)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}, addr, advertise)
+}
+
+func newAggregator(dial func(addr string) (transport, error), addr string, advertise string) (*Aggregator, error) {
+	ag := &Aggregator{
+		dial:      dial,
+		advertise: advertise,
 	}
-	urlObj, err := url.Parse(addr)
+	if addr != "" {
+		if err := ag.SetAddress(addr); err != nil {
+			return nil, err
+		}
+	}
+	if advertise != "" {
+		advertiseUrl, err := url.Parse(advertise)
+		if err != nil {
+			return nil, err
+		}
+		if (advertiseUrl.Scheme != "http" && advertiseUrl.Scheme != "https") || advertiseUrl.Host == "" {
+			return nil, fmt.Errorf("advertised address %q is not an http URL", advertise)
+		}
+		log.Println("[INFO] Advertising this node at", advertiseUrl.String())
+	}
+	return ag, nil
+}
+
+// SetAddress sets the address of the aggregator to communicate with.
+func (ag *Aggregator) SetAddress(addr string) error {
+	t, err := ag.dial(addr)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Println("[INFO] Communicating with aggregator server at", urlObj.String())
+	log.Println("[INFO] Communicating with aggregator server at", addr)
 
-	return &Aggregator{
-		baseUrl: urlObj,
-		client:  client,
-	}, nil
+	ag.mutex.Lock()
+	previous := ag.transport
+	ag.transport = t
+	ag.mutex.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	return nil
+}
+
+// SetTLS sets whether the node serves its files over https, for the
+// aggregator to reach it that way at the address it connects from.
+func (ag *Aggregator) SetTLS(tls bool) {
+	ag.mutex.Lock()
+	ag.tls = tls
+	ag.mutex.Unlock()
 }
-func (ag *Aggregator) Hello(instance string, listenPort uint) error {
-	body := lib.HelloOperation{
-		BaseMessage: lib.BaseMessage{instance},
-		Port:        listenPort,
+
+// Configured returns true once the address of an aggregator is known.
+func (ag *Aggregator) Configured() bool {
+	ag.mutex.RLock()
+	defer ag.mutex.RUnlock()
+	return ag.transport != nil
+}
+
+// Close closes any connection to the aggregator.
+func (ag *Aggregator) Close() {
+	ag.mutex.Lock()
+	t := ag.transport
+	ag.transport = nil
+	ag.mutex.Unlock()
+	if t != nil {
+		t.close()
+	}
+}
+
+// current returns the transport to the aggregator.
+func (ag *Aggregator) current() (transport, error) {
+	ag.mutex.RLock()
+	defer ag.mutex.RUnlock()
+	if ag.transport == nil {
+		return nil, errors.New("no aggregation server address configured")
 	}
-	return ag.send(http.MethodPost, "hello", body)
+	return ag.transport, nil
 }
 
-func (ag *Aggregator) Bye(instance string) error {
-	body := lib.ByeOperation{lib.BaseMessage{instance}}
-	return ag.send(http.MethodPost, "bye", body)
+func (ag *Aggregator) Hello(instance string, epoch int, listenPort uint, label string, seqNo int) error {
+	ag.mutex.RLock()
+	tls := ag.tls
+	ag.mutex.RUnlock()
+	body := protocol.HelloOperation{
+		BaseMessage:  protocol.BaseMessage{Instance: instance, Epoch: epoch},
+		Port:         listenPort,
+		Label:        label,
+		Sequence:     seqNo,
+		Advertise:    ag.advertise,
+		TLS:          tls,
+		Version:      protocol.Version,
+		Capabilities: protocol.Capabilities,
+	}
+	t, err := ag.current()
+	if err != nil {
+		return err
+	}
+	return t.hello(body)
 }
 
-func (ag *Aggregator) NotifyUpdate(op string, filename string, seqNo int, instance string) error {
-	body := []lib.PatchOperation{
-		lib.PatchOperation{
-			Op: op,
-			Value: lib.FileMetadata{
-				Filename: filename,
-			},
+func (ag *Aggregator) Bye(instance string, epoch int) error {
+	body := protocol.ByeOperation{BaseMessage: protocol.BaseMessage{Instance: instance, Epoch: epoch}}
+	t, err := ag.current()
+	if err != nil {
+		return err
+	}
+	return t.bye(body)
+}
+
+func (ag *Aggregator) NotifyUpdate(op string, file protocol.FileMetadata, seqNo int, instance string, epoch int) error {
+	body := []protocol.PatchOperation{
+		{
+			Op:          op,
+			Value:       file,
 			Sequence:    seqNo,
-			BaseMessage: lib.BaseMessage{instance},
+			BaseMessage: protocol.BaseMessage{Instance: instance, Epoch: epoch},
 		},
 	}
-	return ag.send(http.MethodPatch, "files", body)
+	_, err := ag.Patch(body)
+	return err
 }
 
-func (ag *Aggregator) send(method, path string, body interface{}) error {
-	if ag.baseUrl == nil {
-		return errors.New("no aggregation server address configured")
+// Patch sends a set of operations to the aggregator in a single request,
+// returning what became of each. The response is empty if the aggregator
+// doesn't report results.
+func (ag *Aggregator) Patch(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+	var response protocol.PatchResponse
+	t, err := ag.current()
+	if err != nil {
+		return response, err
 	}
+	err = t.patch(ops, &response)
+	// The aggregator responds not found when some of the operations are
+	// for instances it doesn't know, which the results then show.
+	if statusErr, ok := err.(*StatusError); ok && statusErr.Code == http.StatusNotFound && len(response.Results) > 0 {
+		return response, nil
+	}
+	return response, err
+}
+
+// httpTransport makes an HTTP request to the aggregator for each message.
+type httpTransport struct {
+	baseUrl *url.URL
+	client  *http.Client
+	secret  []byte
+}
+
+func newHTTPTransport(client *http.Client, addr string, secret []byte) (*httpTransport, error) {
+	urlObj, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if (urlObj.Scheme != "http" && urlObj.Scheme != "https") || urlObj.Host == "" {
+		return nil, fmt.Errorf("aggregator address %q is not an http URL", addr)
+	}
+	return &httpTransport{baseUrl: urlObj, client: client, secret: secret}, nil
+}
+
+func (t *httpTransport) hello(body protocol.HelloOperation) error {
+	return t.send(http.MethodPost, "hello", body, nil)
+}
+
+func (t *httpTransport) bye(body protocol.ByeOperation) error {
+	return t.send(http.MethodPost, "bye", body, nil)
+}
+
+func (t *httpTransport) patch(ops []protocol.PatchOperation, response *protocol.PatchResponse) error {
+	return t.send(http.MethodPatch, "files", ops, response)
+}
+
+func (t *httpTransport) close() {}
+
+// send makes a request to the aggregator, decoding any response
+// body into result if it isn't nil.
+func (t *httpTransport) send(method, path string, body interface{}, result interface{}) error {
 	u, err := url.Parse(path)
 	if err != nil {
 		return err
@@ -76,29 +239,71 @@ func (ag *Aggregator) send(method, path string, body interface{}) error {
 
 	req, err := http.NewRequest(
 		method,
-		ag.baseUrl.ResolveReference(u).String(),
+		t.baseUrl.ResolveReference(u).String(),
 		bytes.NewReader(payload),
 	)
-	req.Header.Set("Content-Type", "application/json")
-
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.secret != nil {
+		signature, err := protocol.Sign(t.secret, method, req.URL.Path, payload, time.Now())
+		if err != nil {
+			return err
+		}
+		signature.SetHeader(req.Header)
+	}
 
-	resp, err := ag.client.Do(req)
+	resp, err := t.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("Aggregator client error: %s", err.Error())
 	}
 
 	defer resp.Body.Close()
-	_, bodyErr := ioutil.ReadAll(resp.Body)
+	respBody, bodyErr := ioutil.ReadAll(resp.Body)
 	if bodyErr != nil {
 		return fmt.Errorf("Aggregator client error: %s", bodyErr.Error())
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Aggregator client non-200 response: %s", resp.Status)
+	if result != nil && len(bytes.TrimSpace(respBody)) > 0 {
+		if err := json.Unmarshal(respBody, result); err != nil && resp.StatusCode == http.StatusOK {
+			return fmt.Errorf("Aggregator client bad response: %s", err.Error())
+		}
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &StatusError{Code: resp.StatusCode, Status: resp.Status}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			statusErr.Message = strings.TrimSpace(string(respBody))
+		}
+		return statusErr
+	}
 	return nil
 }
+
+// StatusError is returned when the aggregator responds
+// with a status other than 200. Message holds the reason
+// the aggregator gave, if any.
+type StatusError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+// Rejected returns true if the aggregator refused the request itself,
+// rather than being unable to handle it for now, so that sending it
+// again would only be refused again.
+func (e *StatusError) Rejected() bool {
+	switch e.Code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.Code >= 400 && e.Code < 500
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("Aggregator client non-200 response: %s: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("Aggregator client non-200 response: %s", e.Status)
+}
@@ -0,0 +1,210 @@
+package aggregator
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"thirdlight.com/protocol"
+	"thirdlight.com/protocol/rpc"
+)
+
+// NewGRPC returns a client for the aggregator serving gRPC at addr, given
+// as host:port, which sends its messages on a single stream rather than
+// making a request for each. advertise and secret are as for New. If
+// tlsConfig isn't nil, the connection is made over TLS with it. Requests
+// not acknowledged within timeout fail, unless it's zero.
+func NewGRPC(addr string, advertise string, secret []byte, tlsConfig *tls.Config, timeout time.Duration) (*Aggregator, error) {
+	return newAggregator(func(addr string) (transport, error) {
+		t, err := newGRPCTransport(addr, secret, tlsConfig, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}, addr, advertise)
+}
+
+// grpcTransport sends messages on a stream to the aggregator, opened
+// when first needed and again whenever it fails. Requests may be sent
+// while others await their acknowledgement.
+type grpcTransport struct {
+	conn    *grpc.ClientConn
+	secret  []byte
+	timeout time.Duration
+
+	// mutex guards the stream and the requests awaiting acknowledgement
+	// on it. It isn't held while sending, as acknowledgements can't be
+	// handed out without it: should flow control hold up a request until
+	// the aggregator can send its acknowledgements, the stream would stall.
+	mutex   sync.Mutex
+	stream  rpc.Aggregator_SyncClient
+	cancel  context.CancelFunc
+	pending map[uint64]chan *rpc.Ack
+	nextID  uint64
+	// sending is held while sending, so requests aren't interleaved.
+	sending sync.Mutex
+}
+
+func newGRPCTransport(addr string, secret []byte, tlsConfig *tls.Config, timeout time.Duration) (*grpcTransport, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("aggregator address %q is not host:port", addr)
+	}
+	security := grpc.WithInsecure()
+	if tlsConfig != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	// The connection is made in the background,
+	// and remade if it's lost.
+	conn, err := grpc.Dial(addr, security)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTransport{
+		conn:    conn,
+		secret:  secret,
+		timeout: timeout,
+		pending: make(map[uint64]chan *rpc.Ack),
+	}, nil
+}
+
+func (t *grpcTransport) hello(body protocol.HelloOperation) error {
+	_, err := t.request(rpc.HelloMessage(body))
+	return err
+}
+
+func (t *grpcTransport) bye(body protocol.ByeOperation) error {
+	_, err := t.request(rpc.ByeMessage(body))
+	return err
+}
+
+func (t *grpcTransport) patch(ops []protocol.PatchOperation, response *protocol.PatchResponse) error {
+	ack, err := t.request(rpc.PatchMessage(ops))
+	if ack != nil && ack.Patch != nil {
+		*response = ack.Patch.Protocol()
+	}
+	return err
+}
+
+func (t *grpcTransport) close() {
+	t.mutex.Lock()
+	if t.stream != nil {
+		t.reset(t.stream)
+	}
+	t.mutex.Unlock()
+	t.conn.Close()
+}
+
+// request sends a message on the stream and waits for the aggregator
+// to acknowledge it, returning the acknowledgement even if it's an error.
+func (t *grpcTransport) request(message *rpc.Message) (*rpc.Ack, error) {
+	request, err := rpc.NewRequest(message)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	if t.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := rpc.NewAggregatorClient(t.conn).Sync(ctx)
+		if err != nil {
+			t.mutex.Unlock()
+			cancel()
+			return nil, fmt.Errorf("Aggregator client error: %s", err.Error())
+		}
+		t.stream, t.cancel = stream, cancel
+		go t.receive(stream)
+	}
+	stream := t.stream
+	t.nextID++
+	request.Id = t.nextID
+	if t.secret != nil {
+		if err := request.Sign(t.secret, time.Now()); err != nil {
+			t.mutex.Unlock()
+			return nil, err
+		}
+	}
+	acks := make(chan *rpc.Ack, 1)
+	t.pending[request.Id] = acks
+	t.mutex.Unlock()
+
+	t.sending.Lock()
+	err = stream.Send(request)
+	t.sending.Unlock()
+	if err != nil {
+		t.mutex.Lock()
+		t.reset(stream)
+		t.mutex.Unlock()
+		return nil, fmt.Errorf("Aggregator client error: %s", err.Error())
+	}
+
+	var expired <-chan time.Time
+	if t.timeout > 0 {
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case ack, ok := <-acks:
+		if !ok {
+			return nil, errors.New("Aggregator client error: stream closed")
+		}
+		if ack.Code != http.StatusOK {
+			code := int(ack.Code)
+			return ack, &StatusError{
+				Code:    code,
+				Status:  fmt.Sprintf("%d %s", code, http.StatusText(code)),
+				Message: ack.Error,
+			}
+		}
+		return ack, nil
+	case <-expired:
+		t.mutex.Lock()
+		delete(t.pending, request.Id)
+		t.mutex.Unlock()
+		return nil, errors.New("Aggregator client error: timed out awaiting acknowledgement")
+	}
+}
+
+// receive hands the acknowledgements arriving on a stream to the
+// requests awaiting them, until the stream fails.
+func (t *grpcTransport) receive(stream rpc.Aggregator_SyncClient) {
+	for {
+		ack, err := stream.Recv()
+		t.mutex.Lock()
+		if err != nil {
+			if t.stream == stream {
+				log.Println("[ERROR] Aggregator stream closed:", err)
+			}
+			t.reset(stream)
+			t.mutex.Unlock()
+			return
+		}
+		acks := t.pending[ack.Id]
+		delete(t.pending, ack.Id)
+		t.mutex.Unlock()
+		if acks != nil {
+			acks <- ack
+		}
+	}
+}
+
+// reset drops a failed stream, failing the requests awaiting
+// acknowledgement on it. The caller must hold the mutex.
+func (t *grpcTransport) reset(stream rpc.Aggregator_SyncClient) {
+	if t.stream != stream {
+		return
+	}
+	t.cancel()
+	t.stream = nil
+	for id, acks := range t.pending {
+		close(acks)
+		delete(t.pending, id)
+	}
+}
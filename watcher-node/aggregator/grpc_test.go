@@ -0,0 +1,131 @@
+package aggregator
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dawsonalex/aggregator/server"
+	"github.com/dawsonalex/aggregator/watcher"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"thirdlight.com/protocol"
+	"thirdlight.com/protocol/rpc"
+)
+
+// serveStream starts an aggregator serving gRPC streams for the nodes
+// in reg, returning its address and a function to stop it.
+func serveStream(t *testing.T, reg *watcher.Registry) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	rpc.RegisterAggregatorServer(srv, server.NewStreamServer(reg, nil, false))
+	go srv.Serve(listener)
+	return listener.Addr().String(), srv.Stop
+}
+
+// TestGRPC checks that hellos, patches and byes reach an aggregator's
+// stream server, and its acknowledgements come back.
+func TestGRPC(t *testing.T) {
+	id := uuid.New()
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"instance":%q,"epoch":1,"seqno":1,"files":[{"filename":"base.txt"}]}`, id)
+	}))
+	defer node.Close()
+	reg := watcher.NewRegistry(nil)
+	addr, stop := serveStream(t, reg)
+	defer stop()
+
+	ag, err := NewGRPC(addr, node.URL, nil, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Close()
+	if err := ag.Hello(id.String(), 1, 4000, "docs", 0); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ag.Patch([]protocol.PatchOperation{
+		{BaseMessage: protocol.BaseMessage{Instance: id.String(), Epoch: 1}, Op: protocol.OpAdd, Value: protocol.FileMetadata{Filename: "new.txt"}, Sequence: 2},
+		{BaseMessage: protocol.BaseMessage{Instance: uuid.New().String(), Epoch: 1}, Op: protocol.OpAdd, Value: protocol.FileMetadata{Filename: "lost.txt"}, Sequence: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 2 || response.Results[0].Status != protocol.StatusApplied || response.Results[1].Status != protocol.StatusUnknownNode {
+		t.Errorf("expected the first operation applied and the second for an unknown node, got %+v", response.Results)
+	}
+	if n := reg.Node(id); n == nil || len(n.ListFiles()) != 2 {
+		t.Fatal("expected node to have been registered and patched")
+	}
+	err = ag.Hello("not an instance", 1, 4000, "docs", 0)
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid hello to be refused, got %v", err)
+	}
+	if err := ag.Bye(id.String(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if reg.Node(id) != nil {
+		t.Error("expected node to have been removed")
+	}
+}
+
+// TestGRPCFlowControl checks that large requests sent at once don't
+// deadlock the stream, with the node blocked sending requests while
+// the aggregator is blocked sending their acknowledgements.
+func TestGRPCFlowControl(t *testing.T) {
+	addr, stop := serveStream(t, watcher.NewRegistry(nil))
+	ag, err := NewGRPC(addr, "", nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each operation is for an unknown node, so each
+	// has a result in the acknowledgement.
+	ops := make([]protocol.PatchOperation, 2000)
+	for i := range ops {
+		ops[i] = protocol.PatchOperation{
+			BaseMessage: protocol.BaseMessage{Instance: uuid.New().String(), Epoch: 1},
+			Op:          protocol.OpAdd,
+			Value:       protocol.FileMetadata{Filename: fmt.Sprintf("file-%d.txt", i)},
+			Sequence:    1,
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := ag.Patch(ops)
+			if err == nil && len(response.Results) != len(ops) {
+				err = fmt.Errorf("expected %d results, got %d", len(ops), len(response.Results))
+			}
+			errs <- err
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		// Closing the stream would wait on it too.
+		t.Fatal("stream deadlocked")
+	}
+	ag.Close()
+	stop()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
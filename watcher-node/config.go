@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"thirdlight.com/layered"
+	"thirdlight.com/watcher-node/filestore"
+)
+
+// envPrefix starts the names of the environment variables settings
+// can be given in, such as WATCHER_POLL_INTERVAL for poll-interval.
+const envPrefix = "WATCHER"
+
+// config holds the node's settings.
+type config struct {
+	Dirs            []string      `mapstructure:"dirs"`
+	Port            uint          `mapstructure:"port"`
+	LogLevel        string        `mapstructure:"log-level"`
+	Aggregator      string        `mapstructure:"aggregator"`
+	AggregatorName  string        `mapstructure:"aggregator-name"`
+	Transport       string        `mapstructure:"transport"`
+	Advertise       string        `mapstructure:"advertise"`
+	HelloInterval   time.Duration `mapstructure:"hello-interval"`
+	RequestTimeout  time.Duration `mapstructure:"request-timeout"`
+	ShutdownTimeout time.Duration `mapstructure:"shutdown-timeout"`
+	SecretFile      string        `mapstructure:"secret-file"`
+	TLSCert         string        `mapstructure:"tls-cert"`
+	TLSKey          string        `mapstructure:"tls-key"`
+	TLSCA           string        `mapstructure:"tls-ca"`
+	Includes        []string      `mapstructure:"includes"`
+	Excludes        []string      `mapstructure:"excludes"`
+	Poll            bool          `mapstructure:"poll"`
+	PollInterval    time.Duration `mapstructure:"poll-interval"`
+	RescanInterval  time.Duration `mapstructure:"rescan-interval"`
+	OutboxDir       string        `mapstructure:"outbox-dir"`
+	OutboxMemory    int           `mapstructure:"outbox-memory"`
+	BatchWindow     time.Duration `mapstructure:"batch-window"`
+	BatchSize       int           `mapstructure:"batch-size"`
+	ChangeLog       int           `mapstructure:"change-log"`
+	StateDir        string        `mapstructure:"state-dir"`
+}
+
+var settings = []layered.Setting{
+	{Key: "dirs", Flag: "dir", Value: []string{}, Usage: fmt.Sprintf("the path of a directory to watch, may be repeated or comma separated, optionally as label=path (default %q)", mountedDir)},
+	{Key: "port", Flag: "p", Value: defaultPort, Usage: "the port"},
+	{Key: "log-level", Flag: "log", Value: defaultLogLevel, Usage: "the least severe messages to log, info or error"},
+	{Key: "aggregator", Value: "", Usage: "the aggregation server address, host:port for -transport=grpc"},
+	{Key: "aggregator-name", Value: "", Usage: "the common or DNS name in the certificate of an aggregator that may subscribe without signing the request, with -tls-ca"},
+	{Key: "transport", Value: "http", Usage: "how to send changes to the aggregator, http or grpc"},
+	{Key: "advertise", Value: "", Usage: "the base URL the aggregator should reach this node at, such as http://watcher.example.com:4000 (default the address the node connects from)"},
+	{Key: "hello-interval", Value: defaultHelloInterval, Usage: "how often the node says hello to the aggregator"},
+	{Key: "request-timeout", Value: defaultRequestTimeout, Usage: "how long to wait for the aggregator to answer a request, 0 for no limit"},
+	{Key: "shutdown-timeout", Value: defaultShutdownTimeout, Usage: "how long to try delivering outstanding changes when stopping"},
+	{Key: "secret-file", Value: "", Usage: "a file holding the secret shared with the aggregator to sign requests with"},
+	{Key: "tls-cert", Value: "", Usage: "a PEM file holding the certificate to serve HTTPS with, and present to the aggregator"},
+	{Key: "tls-key", Value: "", Usage: "a PEM file holding the private key of -tls-cert"},
+	{Key: "tls-ca", Value: "", Usage: "a PEM file holding the certificate authorities that sign the aggregator's certificate, which it must then present"},
+	{Key: "includes", Flag: "include", Value: []string{}, Usage: "a glob pattern of entries to report, may be repeated"},
+	{Key: "excludes", Flag: "exclude", Value: []string{}, Usage: "a glob pattern of entries not to report, may be repeated"},
+	{Key: "poll", Value: false, Usage: "scan directories periodically instead of using filesystem notifications"},
+	{Key: "poll-interval", Value: defaultPollInterval, Usage: "how often polled directories are scanned"},
+	{Key: "rescan-interval", Value: defaultRescanInterval, Usage: "how often watched directories are fully rescanned to correct missed events, 0 to disable"},
+	{Key: "outbox-dir", Value: "", Usage: "a directory to spill undelivered operations to and keep them in across restarts"},
+	{Key: "outbox-memory", Value: defaultOutboxMemory, Usage: "the most undelivered operations held in memory before spilling to -outbox-dir, or without one, dropping them and resyncing"},
+	{Key: "batch-window", Value: defaultBatchWindow, Usage: "how long to wait for further changes to send together, 0 to send immediately"},
+	{Key: "batch-size", Value: defaultBatchSize, Usage: "the most operations sent to the aggregator in one request"},
+	{Key: "change-log", Value: filestore.DefaultChangeLog, Usage: "the number of recent changes kept for each directory, for an aggregator that missed some to fetch"},
+	{Key: "state-dir", Value: "", Usage: "the directory to keep the node's identity in across restarts (default watcher-node in the user's config directory, such as ~/.config/watcher-node)"},
+}
+
+// loadConfig reads the settings into cfg from, in increasing precedence,
+// their defaults, the file given by -config, the environment and the
+// flags in args, defined on flags. It returns true if -print-config
+// was given.
+func loadConfig(flags *flag.FlagSet, args []string, cfg *config) (bool, error) {
+	printConfig, err := layered.Load(flags, args, envPrefix, settings, cfg)
+	if err != nil {
+		return false, err
+	}
+	return printConfig, cfg.validate()
+}
+
+// validate checks the settings are usable together.
+func (c *config) validate() error {
+	if c.Port == 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if !validLogLevel(c.LogLevel) {
+		return fmt.Errorf("unknown log-level %q, expected info or error", c.LogLevel)
+	}
+	if c.Transport != "http" && c.Transport != "grpc" {
+		return fmt.Errorf("unknown transport %q, expected http or grpc", c.Transport)
+	}
+	if c.HelloInterval <= 0 {
+		return errors.New("hello-interval must be positive")
+	}
+	if c.RequestTimeout < 0 {
+		return errors.New("request-timeout can't be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown-timeout must be positive")
+	}
+	if c.PollInterval <= 0 {
+		return errors.New("poll-interval must be positive")
+	}
+	if c.RescanInterval < 0 {
+		return errors.New("rescan-interval can't be negative")
+	}
+	if c.OutboxMemory < 1 {
+		return errors.New("outbox-memory must be at least 1")
+	}
+	if c.BatchWindow < 0 {
+		return errors.New("batch-window can't be negative")
+	}
+	if c.BatchSize < 1 {
+		return errors.New("batch-size must be at least 1")
+	}
+	if c.ChangeLog < 0 {
+		return errors.New("change-log can't be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if c.AggregatorName != "" && c.TLSCA == "" {
+		return errors.New("aggregator-name requires tls-ca")
+	}
+	return nil
+}
+
+// print writes the settings as YAML, as they could be given in a file.
+func (c config) print(w io.Writer) error {
+	return layered.Print(w, c)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestConfig checks that settings are layered from defaults, a file, the
+// environment and flags, each overriding the last.
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "watcher.toml")
+	contents := "port = 4100\ntransport = \"grpc\"\ndirs = [\"docs=/srv/docs\", \"/srv/photos\"]\npoll = true\n"
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("WATCHER_TRANSPORT", "http")
+	os.Setenv("WATCHER_EXCLUDES", "*.tmp,*.swp")
+	defer os.Unsetenv("WATCHER_TRANSPORT")
+	defer os.Unsetenv("WATCHER_EXCLUDES")
+
+	var cfg config
+	args := []string{"-config", file, "-p", "4200", "-hello-interval", "1m", "-print-config"}
+	printConfig, err := loadConfig(flag.NewFlagSet("watcher-node", flag.ContinueOnError), args, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Error("expected -print-config to be set")
+	}
+	expected := []struct {
+		setting  string
+		got      interface{}
+		expected interface{}
+	}{
+		{"port from a flag", cfg.Port, uint(4200)},
+		{"transport from the environment", cfg.Transport, "http"},
+		{"dirs from the file", cfg.Dirs, []string{"docs=/srv/docs", "/srv/photos"}},
+		{"poll from the file", cfg.Poll, true},
+		{"excludes from the environment", cfg.Excludes, []string{"*.tmp", "*.swp"}},
+		{"hello-interval from a flag", cfg.HelloInterval, time.Minute},
+		{"batch-size by default", cfg.BatchSize, defaultBatchSize},
+	}
+	for _, test := range expected {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.setting, test.expected, test.got)
+		}
+	}
+
+	invalid := [][]string{
+		{"-p", "70000"},
+		{"-transport", "smtp"},
+		{"-log", "debug"},
+		{"-hello-interval", "0"},
+		{"-batch-size", "0"},
+		{"-tls-key", "key.pem"},
+		{"-aggregator-name", "aggregator"},
+	}
+	for _, args := range invalid {
+		var cfg config
+		if _, err := loadConfig(flag.NewFlagSet("watcher-node", flag.ContinueOnError), args, &cfg); err == nil {
+			t.Errorf("expected %v to be refused", args)
+		}
+	}
+}
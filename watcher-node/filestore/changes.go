@@ -0,0 +1,75 @@
+package filestore
+
+// DefaultChangeLog is the number of recent changes a store keeps.
+const DefaultChangeLog = 1000
+
+// Change is a single change made to the store.
+type Change struct {
+	Op       string
+	Filename string
+	File     File
+	Sequence int
+}
+
+// changeLog is a ring buffer of the most recent changes,
+// oldest first from start.
+type changeLog struct {
+	changes []Change
+	start   int
+	count   int
+}
+
+func newChangeLog(size int) changeLog {
+	return changeLog{changes: make([]Change, size)}
+}
+
+func (l *changeLog) add(change Change) {
+	size := len(l.changes)
+	if size == 0 {
+		return
+	}
+	if l.count < size {
+		l.changes[(l.start+l.count)%size] = change
+		l.count++
+		return
+	}
+	l.changes[l.start] = change
+	l.start = (l.start + 1) % size
+}
+
+func (l *changeLog) at(i int) Change {
+	return l.changes[(l.start+i)%len(l.changes)]
+}
+
+// SetChangeLog sets how many recent changes the store keeps,
+// discarding those it holds.
+func (s *Store) SetChangeLog(size int) {
+	if size < 0 {
+		size = 0
+	}
+	s.mutex.Lock()
+	s.log = newChangeLog(size)
+	s.mutex.Unlock()
+}
+
+// ChangesSince returns the changes made after seqno, oldest first, and
+// the sequence number they bring the store up to. It returns false if
+// the store no longer holds all of them.
+func (s *Store) ChangesSince(seqno int) ([]Change, int, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if seqno == s.seqno {
+		return []Change{}, s.seqno, true
+	}
+	if seqno > s.seqno || s.log.count == 0 || s.log.at(0).Sequence > seqno+1 {
+		return nil, s.seqno, false
+	}
+
+	changes := make([]Change, 0, s.seqno-seqno)
+	for i := 0; i < s.log.count; i++ {
+		if change := s.log.at(i); change.Sequence > seqno {
+			changes = append(changes, change)
+		}
+	}
+	return changes, s.seqno, true
+}
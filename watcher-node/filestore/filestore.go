@@ -1,59 +1,180 @@
 package filestore
 
 import (
-	"os"
 	"sync"
 
 	"github.com/google/uuid"
 )
 
 type Store struct {
-	list     map[string]struct{}
+	// list is copied before it is changed if it has been shared with a
+	// snapshot, so snapshots never see later changes.
+	list     map[string]File
+	shared   bool
 	mutex    sync.RWMutex
 	instance string
+	label    string
+	epoch    int
 	seqno    int
+	// log holds the most recent changes, for nodes that
+	// have missed some to catch up from.
+	log changeLog
 }
 
-type fileList map[string]struct{}
+// File is the metadata kept for each entry in the store.
+// Hash is empty for entries that have no content, such as directories.
+type File struct {
+	Size int64
+	Hash string
+	Dir  bool
+}
+
+type fileList map[string]File
 
-func New() *Store {
+func New(label string) *Store {
 	return &Store{
 		list:     fileList{},
 		mutex:    sync.RWMutex{},
 		seqno:    0,
 		instance: uuid.New().String(),
+		label:    label,
+		epoch:    1,
+		log:      newChangeLog(DefaultChangeLog),
 	}
 }
 
-func (s *Store) AddFiles(files []os.FileInfo) {
+// Resume returns an empty store that continues the instance and
+// sequence numbers of a store from an earlier run, in the epoch
+// following that run's.
+func Resume(label string, instance string, seqno int, epoch int) *Store {
+	store := New(label)
+	store.instance = instance
+	store.seqno = seqno
+	store.epoch = epoch + 1
+	return store
+}
+
+// AddFiles adds many files to the store as a single change. The change
+// isn't kept in the change log, so the log is emptied, and nodes that
+// were behind it must fetch the whole file list instead.
+func (s *Store) AddFiles(files map[string]File) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.seqno = s.seqno + 1
-	for _, file := range files {
-		s.list[file.Name()] = struct{}{}
+	s.writable()
+	for name, file := range files {
+		s.list[name] = file
 	}
+	s.log = newChangeLog(len(s.log.changes))
 }
 
 func (s *Store) Instance() string {
 	return s.instance
 }
 
-func (s *Store) Update(op string, filename string) int {
+// Sequence returns the sequence number of the latest change to the store.
+func (s *Store) Sequence() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.seqno
+}
+
+// Epoch returns the number of the run the store belongs to.
+func (s *Store) Epoch() int {
+	return s.epoch
+}
+
+// Label returns the human readable name of the directory the store holds.
+func (s *Store) Label() string {
+	return s.label
+}
+
+func (s *Store) Update(op string, filename string, file File) int {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.seqno += 1
 	toRet := s.seqno
 	switch op {
-	case "add":
-		s.list[filename] = struct{}{}
+	case "add", "modify":
+		s.writable()
+		s.list[filename] = file
 	case "remove":
+		s.writable()
 		delete(s.list, filename)
 	}
+	s.log.add(Change{Op: op, Filename: filename, File: file, Sequence: toRet})
 	return toRet
 }
 
-func (s *Store) GetList() (fileList, int) {
+// Get returns the metadata held for filename, and whether it is in the store.
+func (s *Store) Get(filename string) (File, bool) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return s.list, s.seqno
+	file, ok := s.list[filename]
+	return file, ok
+}
+
+// GetList returns a copy of the files in the store, and the
+// sequence number of the latest change to them.
+func (s *Store) GetList() (fileList, int) {
+	snapshot := s.Snapshot()
+	list := make(fileList, snapshot.Len())
+	snapshot.Each(func(name string, file File) {
+		list[name] = file
+	})
+	return list, snapshot.Sequence()
+}
+
+// Snapshot returns a view of the files in the store as of the latest
+// change, which later changes leave untouched.
+func (s *Store) Snapshot() Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shared = true
+	return Snapshot{files: s.list, seqno: s.seqno}
+}
+
+// writable copies the list if a snapshot shares it, so it can be
+// changed. The store must be locked for writing.
+func (s *Store) writable() {
+	if !s.shared {
+		return
+	}
+	list := make(fileList, len(s.list))
+	for name, file := range s.list {
+		list[name] = file
+	}
+	s.list = list
+	s.shared = false
+}
+
+// Snapshot is an unchanging view of the files in a
+// store as of a particular sequence number.
+type Snapshot struct {
+	files fileList
+	seqno int
+}
+
+// Sequence returns the sequence number of the latest
+// change included in the snapshot.
+func (sn Snapshot) Sequence() int {
+	return sn.seqno
+}
+
+// Len returns the number of files in the snapshot.
+func (sn Snapshot) Len() int {
+	return len(sn.files)
+}
+
+// Get returns the metadata of filename, and whether it is in the snapshot.
+func (sn Snapshot) Get(filename string) (File, bool) {
+	file, ok := sn.files[filename]
+	return file, ok
+}
+
+// Each calls fn for every file in the snapshot, in no particular order.
+func (sn Snapshot) Each(fn func(name string, file File)) {
+	for name, file := range sn.files {
+		fn(name, file)
+	}
 }
@@ -1,7 +1,9 @@
 package filestore
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -10,6 +12,7 @@ func TestUpdate(t *testing.T) {
 		scenario          string
 		op                string
 		filename          string
+		file              File
 		actualStoreList   fileList
 		expectedStoreList fileList
 	}{
@@ -31,6 +34,18 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedStoreList: fileList{},
 		},
+		{
+			scenario: "modify file",
+			op:       "modify",
+			filename: "file.txt",
+			file:     File{Size: 4, Hash: "abcd"},
+			actualStoreList: fileList{
+				"file.txt": {},
+			},
+			expectedStoreList: fileList{
+				"file.txt": {Size: 4, Hash: "abcd"},
+			},
+		},
 		{
 			scenario: "unknown op",
 			op:       "move",
@@ -48,14 +63,120 @@ func TestUpdate(t *testing.T) {
 		store := Store{
 			list: test.actualStoreList,
 		}
-		store.Update(test.op, test.filename)
-		if !reflect.DeepEqual(store.GetList(), test.expectedStoreList) {
+		store.Update(test.op, test.filename, test.file)
+		list, _ := store.GetList()
+		if !reflect.DeepEqual(list, test.expectedStoreList) {
 			t.Errorf(
 				"%s, expected: %v, got: %v",
 				test.scenario,
 				test.expectedStoreList,
-				store.GetList(),
+				list,
 			)
 		}
 	}
 }
+
+func TestChangesSince(t *testing.T) {
+	store := New("test")
+	store.SetChangeLog(3)
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		if seqno := store.Update("add", name, File{Size: int64(i)}); seqno != i+1 {
+			t.Fatalf("expected seqno %d, got %d", i+1, seqno)
+		}
+	}
+
+	tests := []struct {
+		since    int
+		expected []int
+		ok       bool
+	}{
+		{5, []int{}, true},
+		{3, []int{4, 5}, true},
+		{2, []int{3, 4, 5}, true},
+		{1, nil, false},
+		{6, nil, false},
+	}
+	for _, test := range tests {
+		changes, seqno, ok := store.ChangesSince(test.since)
+		if ok != test.ok || seqno != 5 {
+			t.Errorf("since %d: expected %v at 5, got %v at %d", test.since, test.ok, ok, seqno)
+			continue
+		}
+		var sequences []int
+		if changes != nil {
+			sequences = make([]int, 0)
+			for _, change := range changes {
+				sequences = append(sequences, change.Sequence)
+			}
+		}
+		if !reflect.DeepEqual(sequences, test.expected) {
+			t.Errorf("since %d: expected %v, got %v", test.since, test.expected, sequences)
+		}
+	}
+}
+
+// TestChangesSinceAddFiles checks that changes from before files were
+// added in bulk, which aren't logged, are no longer held.
+func TestChangesSinceAddFiles(t *testing.T) {
+	store := New("test")
+	store.Update("add", "a", File{})
+	store.AddFiles(map[string]File{"b": {}, "c": {}})
+	store.Update("add", "d", File{})
+
+	for since, ok := range map[int]bool{0: false, 1: false, 2: true, 3: true} {
+		if _, seqno, held := store.ChangesSince(since); held != ok || seqno != 3 {
+			t.Errorf("since %d: expected %v at 3, got %v at %d", since, ok, held, seqno)
+		}
+	}
+}
+
+// TestSnapshotConcurrentUpdates checks, under the race detector, that
+// snapshots taken while the store changes hold exactly the files as of
+// their sequence number and aren't changed afterwards.
+func TestSnapshotConcurrentUpdates(t *testing.T) {
+	store := New("test")
+	const writers, updates = 4, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				store.Update("add", fmt.Sprintf("%d-%d", w, i), File{Size: int64(i)})
+			}
+		}(w)
+	}
+
+	snapshots := make([]Snapshot, 0)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		snapshot := store.Snapshot()
+		count := 0
+		snapshot.Each(func(name string, file File) {
+			count++
+		})
+		if count != snapshot.Sequence() {
+			t.Fatalf("snapshot at %d holds %d files", snapshot.Sequence(), count)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Len() != snapshot.Sequence() {
+			t.Errorf("snapshot at %d changed to hold %d files", snapshot.Sequence(), snapshot.Len())
+		}
+	}
+	if list, seqno := store.GetList(); len(list) != writers*updates || seqno != writers*updates {
+		t.Errorf("expected %d files, got %d at %d", writers*updates, len(list), seqno)
+	}
+}
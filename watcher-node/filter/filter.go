@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// IgnoreFile is the name of the file in the watched directory
+// that holds gitignore-like exclusion rules.
+const IgnoreFile = ".watcherignore"
+
+// Filter decides which directory entries are reported. Entries must
+// match at least one include pattern, when any are given, and must not
+// match an exclude pattern or be ignored by the rules of the ignore file.
+type Filter struct {
+	includes []string
+	excludes []string
+	rules    []rule
+	mutex    sync.RWMutex
+}
+
+type rule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// New returns a filter for the given include and exclude glob
+// patterns, which use the syntax of filepath.Match.
+func New(includes, excludes []string) (*Filter, error) {
+	for _, pattern := range append(append([]string{}, includes...), excludes...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &Filter{
+		includes: includes,
+		excludes: excludes,
+	}, nil
+}
+
+// Allow reports whether the entry called name should be reported.
+func (f *Filter) Allow(name string, isDir bool) bool {
+	if len(f.includes) > 0 && !matchAny(f.includes, name) {
+		return false
+	}
+	if matchAny(f.excludes, name) {
+		return false
+	}
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	ignored := false
+	// As with gitignore the last matching rule wins, so
+	// a negated rule can re-include an earlier match.
+	for _, r := range f.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if ok, _ := filepath.Match(r.pattern, name); ok {
+			ignored = !r.negate
+		}
+	}
+	return !ignored
+}
+
+// Load replaces the ignore rules with those read from the ignore file
+// in directory. A missing ignore file clears the rules.
+func (f *Filter) Load(directory string) error {
+	rules, err := readRules(filepath.Join(directory, IgnoreFile))
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	f.rules = rules
+	f.mutex.Unlock()
+	return nil
+}
+
+func readRules(path string) ([]rule, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := make([]rule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if r, ok := parseRule(scanner.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(line string) (rule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false
+	}
+
+	var r rule
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// Only the top level of the directory is watched, so anchored
+	// patterns and ones spanning directories match the name alone.
+	line = strings.TrimPrefix(line, "/")
+	line = strings.TrimPrefix(line, "**/")
+	line = strings.Replace(line, "**", "*", -1)
+	if _, err := filepath.Match(line, ""); err != nil || line == "" {
+		return rule{}, false
+	}
+	r.pattern = line
+	return r, true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ignore := "# editor files\n*.swp\n.DS_Store\nbuild/\n*.log\n!keep.log\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, IgnoreFile), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := New(nil, []string{"*.part"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		isDir    bool
+		expected bool
+	}{
+		{name: "cat.jpg", expected: true},
+		{name: "movie.mp4.part", expected: false},
+		{name: ".file.txt.swp", expected: false},
+		{name: ".DS_Store", expected: false},
+		{name: "build", isDir: true, expected: false},
+		{name: "build", expected: true},
+		{name: "debug.log", expected: false},
+		{name: "keep.log", expected: true},
+	}
+
+	for _, test := range tests {
+		if got := f.Allow(test.name, test.isDir); got != test.expected {
+			t.Errorf("%s (dir: %v), expected: %v, got: %v", test.name, test.isDir, test.expected, got)
+		}
+	}
+}
+
+func TestAllowIncludes(t *testing.T) {
+	f, err := New([]string{"*.jpg", "*.png"}, []string{"secret*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Allow("cat.jpg", false) {
+		t.Error("expected cat.jpg to be included")
+	}
+	if f.Allow("notes.txt", false) {
+		t.Error("expected notes.txt not to be included")
+	}
+	if f.Allow("secret.png", false) {
+		t.Error("expected secret.png to be excluded")
+	}
+}
+
+func TestNewInvalidPattern(t *testing.T) {
+	if _, err := New([]string{"[a-"}, nil); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
@@ -1,7 +1,21 @@
 module thirdlight.com/watcher-node
 
-go 1.12
+go 1.13
 
 require github.com/fsnotify/fsnotify v1.4.9
 
 require github.com/google/uuid v1.1.1
+
+require google.golang.org/grpc v1.31.1
+
+require thirdlight.com/protocol v0.0.0
+
+replace thirdlight.com/protocol => ../protocol
+
+require github.com/dawsonalex/aggregator v0.0.0
+
+replace github.com/dawsonalex/aggregator => ../aggregation-server
+
+require thirdlight.com/layered v0.0.0
+
+replace thirdlight.com/layered => ../layered
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// logLevels are the levels messages are logged at, least severe first.
+// Each message gives its level in a prefix, such as [INFO].
+var logLevels = []string{"info", "error"}
+
+// validLogLevel returns true if level is one of logLevels.
+func validLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if l == strings.ToLower(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// levelFilter passes the messages logged to it on to out, dropping those
+// at levels less severe than the one it was made with. Messages without a
+// level are always passed on.
+type levelFilter struct {
+	out  io.Writer
+	drop map[string]bool
+}
+
+// newLevelFilter returns a filter passing on messages at level, which
+// must be one of logLevels, or more severe.
+func newLevelFilter(out io.Writer, level string) *levelFilter {
+	drop := make(map[string]bool)
+	for _, l := range logLevels {
+		if l == strings.ToLower(level) {
+			break
+		}
+		drop[strings.ToUpper(l)] = true
+	}
+	return &levelFilter{out: out, drop: drop}
+}
+
+// Write passes on a message unless its level is dropped. A log.Logger
+// writes each message in a single call, after the time it was logged.
+func (f *levelFilter) Write(p []byte) (int, error) {
+	if start := bytes.IndexByte(p, '['); start >= 0 {
+		if end := bytes.IndexByte(p[start:], ']'); end > 0 && f.drop[string(p[start+1:start+end])] {
+			return len(p), nil
+		}
+	}
+	return f.out.Write(p)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+// TestLevelFilter checks that messages less severe than the level
+// logged at are dropped, and others passed on.
+func TestLevelFilter(t *testing.T) {
+	tests := []struct {
+		level    string
+		expected string
+	}{
+		{"info", "[INFO] started\n[ERROR] failed\nlistening on [::1]:4000\n"},
+		{"ERROR", "[ERROR] failed\nlistening on [::1]:4000\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		logger := log.New(newLevelFilter(&out, test.level), "", 0)
+		logger.Println("[INFO] started")
+		logger.Println("[ERROR] failed")
+		logger.Println("listening on [::1]:4000")
+		if out.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.level, test.expected, out.String())
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -15,70 +17,290 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 
+	"thirdlight.com/protocol"
 	"thirdlight.com/watcher-node/aggregator"
 	"thirdlight.com/watcher-node/filestore"
+	"thirdlight.com/watcher-node/outbox"
 	"thirdlight.com/watcher-node/server"
+	"thirdlight.com/watcher-node/state"
 )
 
 const (
 	mountedDir = "/host/watched-folder"
 	add        = "add"
 	remove     = "remove"
+	modify     = "modify"
 )
 
 var defaultPort uint = 4000
 
+const (
+	defaultPollInterval    = 2 * time.Second
+	defaultRescanInterval  = 5 * time.Minute
+	defaultOutboxMemory    = 10000
+	defaultBatchWindow     = 100 * time.Millisecond
+	defaultBatchSize       = 100
+	defaultHelloInterval   = 5 * time.Second
+	defaultRequestTimeout  = 30 * time.Second
+	defaultShutdownTimeout = 5 * time.Second
+	defaultLogLevel        = "info"
+)
+
 func main() {
+	var cfg config
+	printConfig, err := loadConfig(flag.CommandLine, os.Args[1:], &cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error in configuration:", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	log.SetOutput(newLevelFilter(os.Stderr, cfg.LogLevel))
 	log.Println("[INFO] Starting watcher node")
-	var directory = flag.String("dir", mountedDir, "the path of the directory to watch")
-	var port = flag.Uint("p", defaultPort, "the port")
-	var aggregationServer = flag.String("aggregator", "", "the aggregation server address")
-	flag.Parse()
 
-	aggregatorClient, err := aggregator.New(&http.Client{}, *aggregationServer)
+	directories := cfg.Dirs
+	if len(directories) == 0 {
+		directories = []string{mountedDir}
+	}
+	dirs, labels, err := parseDirs(directories)
+	if err != nil {
+		log.Fatalln("[ERROR]", err)
+	}
+
+	if cfg.StateDir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			log.Fatalln("[ERROR] No -state-dir given, and no default:", err)
+		}
+		cfg.StateDir = filepath.Join(configDir, "watcher-node")
+	}
+	nodeState, err := state.Open(cfg.StateDir)
+	if err != nil {
+		log.Fatalln("[ERROR]", err)
+	}
+
+	var secret []byte
+	if cfg.SecretFile != "" {
+		secret, err = readSecret(cfg.SecretFile)
+		if err != nil {
+			log.Fatalln("[ERROR]", err)
+		}
+	}
+	// With a certificate the node serves HTTPS, and presents it to the
+	// aggregator, which only lets it change the instances it names. With
+	// a certificate authority, the aggregator must present a certificate
+	// it signed, both when fetching files and when receiving changes.
+	var serverTLS, clientTLS *tls.Config
+	if cfg.TLSCert != "" {
+		serverTLS, err = protocol.ServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+		if err != nil {
+			log.Fatalln("[ERROR]", err)
+		}
+		// Only aggregators read from the node, so all of
+		// its endpoints need a certificate, not just some.
+		if cfg.TLSCA != "" {
+			serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if cfg.TLSCert != "" || cfg.TLSCA != "" {
+		clientTLS, err = protocol.ClientTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+		if err != nil {
+			log.Fatalln("[ERROR]", err)
+		}
+	}
+	var aggregatorClient *aggregator.Aggregator
+	switch cfg.Transport {
+	case "http":
+		client := &http.Client{Timeout: cfg.RequestTimeout}
+		if clientTLS != nil {
+			client.Transport = &http.Transport{TLSClientConfig: clientTLS}
+		}
+		aggregatorClient, err = aggregator.New(client, cfg.Aggregator, cfg.Advertise, secret)
+	case "grpc":
+		aggregatorClient, err = aggregator.NewGRPC(cfg.Aggregator, cfg.Advertise, secret, clientTLS, cfg.RequestTimeout)
+	}
 	if err != nil {
 		log.Fatalln("[ERROR]", err)
 	}
+	aggregatorClient.SetTLS(serverTLS != nil)
 
-	store, err := initializeStoreForDirectory(*directory)
+	// When the aggregator has missed operations the outbox no longer
+	// holds, a hello with the latest sequence number makes it fetch the
+	// instance's files again.
+	instances := make(map[string]*filestore.Store, len(labels))
+	resync := func(instance string) {
+		store, ok := instances[instance]
+		if !ok {
+			return
+		}
+		if err := aggregatorClient.Hello(store.Instance(), store.Epoch(), cfg.Port, store.Label(), store.Sequence()); err != nil {
+			log.Println("[ERROR]", err)
+		}
+	}
+	// Without an aggregator the node is only polled, and there is
+	// nobody to deliver changes to until one subscribes.
+	if !aggregatorClient.Configured() {
+		log.Println("[INFO] No aggregator given, serving file lists to be polled")
+	}
+	patch := func(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+		if !aggregatorClient.Configured() {
+			return protocol.PatchResponse{}, nil
+		}
+		return aggregatorClient.Patch(ops)
+	}
+	out, err := outbox.New(patch, outbox.Options{
+		Dir:         cfg.OutboxDir,
+		MaxInMemory: cfg.OutboxMemory,
+		Window:      cfg.BatchWindow,
+		MaxBatch:    cfg.BatchSize,
+		Resync:      resync,
+	})
 	if err != nil {
 		log.Fatalln("[ERROR]", err)
 	}
 
+	sources := make(map[string]*source, len(labels))
+	stores := make([]*filestore.Store, 0, len(labels))
+	for _, label := range labels {
+		src, err := newSource(label, dirs[label], cfg.Includes, cfg.Excludes, nodeState)
+		if err != nil {
+			log.Fatalln("[ERROR]", err)
+		}
+		src.store.SetChangeLog(cfg.ChangeLog)
+		out.Start(src.store.Instance(), src.store.Epoch(), src.store.Sequence())
+		sources[src.directory] = src
+		stores = append(stores, src.store)
+		instances[src.store.Instance()] = src.store
+	}
+	go out.Run()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/files", server.FilesHandler(store))
+	mux.HandleFunc("/files", server.FilesHandler(stores))
+	mux.HandleFunc("/changes", server.ChangesHandler(stores))
+
+	hello := func() {
+		if !aggregatorClient.Configured() {
+			return
+		}
+		for _, store := range stores {
+			seqNo, _ := out.Delivered(store.Instance())
+			helloErr := aggregatorClient.Hello(store.Instance(), store.Epoch(), cfg.Port, store.Label(), seqNo)
+			if helloErr != nil {
+				log.Println("[ERROR]", helloErr)
+			}
+		}
+	}
+	mux.HandleFunc("/subscribe", server.SubscribeHandler(secret, cfg.AggregatorName, func(addr string) error {
+		if cfg.Aggregator != "" {
+			return server.ErrSubscribeRefused
+		}
+		if cfg.Transport != "http" {
+			return fmt.Errorf("can't subscribe an aggregator's HTTP address with -transport=%s", cfg.Transport)
+		}
+		if err := aggregatorClient.SetAddress(addr); err != nil {
+			return err
+		}
+		go hello()
+		return nil
+	}))
 
+	// Directories that can't be watched with filesystem notifications,
+	// such as network or FUSE mounts, fall back to being polled.
+	var events chan fsnotify.Event
+	var watchErrors chan error
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Println("[ERROR]", err)
+	} else {
+		defer watcher.Close()
+		events, watchErrors = watcher.Events, watcher.Errors
 	}
-	defer watcher.Close()
 
+	polled := make([]*source, 0)
+	for _, label := range labels {
+		src := sources[dirs[label]]
+		if !cfg.Poll && watcher != nil {
+			err := watcher.Add(src.directory)
+			if err == nil {
+				log.Printf("[INFO] Now watching %s as %q", src.directory, label)
+				continue
+			}
+			log.Println("[ERROR]", err)
+		}
+		src.polled = true
+		polled = append(polled, src)
+		log.Printf("[INFO] Now polling %s as %q every %s", src.directory, label, cfg.PollInterval)
+	}
+
+	// Notifications can be dropped, most visibly when the kernel's queue
+	// overflows, so watched directories are also rescanned periodically
+	// and after an overflow to correct any changes that were missed.
+	rescan := func() {
+		for _, src := range sources {
+			if src.polled {
+				continue
+			}
+			if err := src.reconcile(out); err != nil {
+				log.Println("[ERROR]", err)
+			}
+		}
+	}
+	var rescanTick <-chan time.Time
+	if cfg.RescanInterval > 0 {
+		rescanTicker := time.NewTicker(cfg.RescanInterval)
+		defer rescanTicker.Stop()
+		rescanTick = rescanTicker.C
+	}
+
+	pollTicker := time.NewTicker(cfg.PollInterval)
+	defer pollTicker.Stop()
+	settleTicker := time.NewTicker(modifyDelay / 2)
+	defer settleTicker.Stop()
+	stopEvents, eventsDone := make(chan struct{}), make(chan struct{})
 	go func() {
+		defer close(eventsDone)
 		for {
 			select {
-			case event := <-watcher.Events:
-				handleEvent(event, store, aggregatorClient)
-			case err := <-watcher.Errors:
+			case <-stopEvents:
+				return
+			case event := <-events:
+				if src, ok := sources[filepath.Dir(event.Name)]; ok && !src.polled {
+					src.handleEvent(event, out)
+				}
+			case err := <-watchErrors:
 				log.Println("[ERROR]", err)
+				if err == fsnotify.ErrEventOverflow {
+					log.Println("[INFO] Rescanning directories after missed events")
+					rescan()
+				}
+			case now := <-settleTicker.C:
+				for _, src := range sources {
+					src.settle(now, out)
+				}
+			case <-rescanTick:
+				rescan()
+			case <-pollTicker.C:
+				for _, src := range polled {
+					if err := src.reconcile(out); err != nil {
+						log.Println("[ERROR]", err)
+					}
+				}
 			}
 		}
 	}()
 
-	if err := watcher.Add(*directory); err != nil {
-		log.Println("[ERROR]", err)
-	}
-	log.Println("[INFO] Now watching", *directory)
-
-	if port == nil {
-		port = &defaultPort
-	}
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", *port),
-		Handler: mux,
+		Addr:      fmt.Sprintf(":%d", cfg.Port),
+		Handler:   mux,
+		TLSConfig: serverTLS,
 	}
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGTERM)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
 	go func() {
 		<-sigChan
 		srv.Close()
@@ -87,63 +309,57 @@ func main() {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		log.Println(srv.ListenAndServe())
+		if serverTLS != nil {
+			log.Println(srv.ListenAndServeTLS("", ""))
+		} else {
+			log.Println(srv.ListenAndServe())
+		}
 		wg.Done()
 	}()
 
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(cfg.HelloInterval)
 	go func() {
 		for range ticker.C {
-			helloErr := aggregatorClient.Hello(store.Instance(), *port)
-			if helloErr != nil {
-				log.Println("[ERROR]", helloErr)
+			hello()
+		}
+	}()
+	defer func() {
+		close(stopEvents)
+		<-eventsDone
+		if !out.Flush(cfg.ShutdownTimeout) {
+			log.Printf("[ERROR] %d operations were not delivered", out.Len())
+		}
+		if err := out.Close(); err != nil {
+			log.Println("[ERROR]", err)
+		}
+		for _, src := range sources {
+			if err := src.saveState(); err != nil {
+				log.Println("[ERROR]", err)
+			}
+		}
+		if aggregatorClient.Configured() {
+			for _, store := range stores {
+				aggregatorClient.Bye(store.Instance(), store.Epoch())
 			}
 		}
+		aggregatorClient.Close()
 	}()
-	defer aggregatorClient.Bye(store.Instance())
 
 	wg.Wait()
 	close(sigChan)
 	ticker.Stop()
 }
 
-func initializeStoreForDirectory(directory string) (*filestore.Store, error) {
-	store := filestore.New()
-
-	files, err := ioutil.ReadDir(directory)
+// readSecret returns the secret held in a file, without surrounding
+// whitespace.
+func readSecret(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-
-	store.AddFiles(files)
-	return store, nil
-}
-
-func handleEvent(
-	event fsnotify.Event,
-	store *filestore.Store,
-	aggregator *aggregator.Aggregator,
-) {
-	op := getOp(event)
-	if op == "" {
-		return
-	}
-	filename := filepath.Base(event.Name)
-
-	opSeqNo := store.Update(op, filename)
-
-	err := aggregator.NotifyUpdate(op, filename, opSeqNo, store.Instance())
-	if err != nil {
-		log.Println("[ERROR]: ", err)
-	}
-}
-
-func getOp(event fsnotify.Event) string {
-	switch event.Op {
-	case fsnotify.Create:
-		return add
-	case fsnotify.Remove, fsnotify.Rename:
-		return remove
+	secret := bytes.TrimSpace(contents)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
 	}
-	return ""
+	return secret, nil
 }
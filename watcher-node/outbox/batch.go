@@ -0,0 +1,98 @@
+package outbox
+
+import "thirdlight.com/protocol"
+
+const (
+	add    = "add"
+	remove = "remove"
+	modify = "modify"
+)
+
+// collapse drops the operations in ops made redundant by later ones,
+// working in place. A file that is added and then removed again is left
+// out altogether, and a modification is folded into the add or modify
+// of the same file before it.
+//
+// As dropping operations leaves gaps in the sequence, each remaining
+// operation that no longer follows on directly from the one before is
+// given the sequence number it now follows in Previous. When every
+// operation of an instance is dropped, last records where that
+// instance's sequence now stands, if it isn't already known.
+func collapse(ops []protocol.PatchOperation, last map[string]int) []protocol.PatchOperation {
+	type key struct {
+		instance string
+		filename string
+	}
+	dropped := make([]bool, len(ops))
+	latest := make(map[key]int)
+	for i, op := range ops {
+		k := key{op.Instance, op.Value.Filename}
+		j, seen := latest[k]
+		switch {
+		case seen && op.Op == remove && ops[j].Op == add:
+			dropped[i], dropped[j] = true, true
+			delete(latest, k)
+		case seen && op.Op == modify && (ops[j].Op == add || ops[j].Op == modify):
+			ops[j].Value = op.Value
+			dropped[i] = true
+		default:
+			latest[k] = i
+		}
+	}
+
+	prev := make(map[string]int)
+	kept := make(map[string]bool)
+	collapsed := ops[:0]
+	for i, op := range ops {
+		if _, ok := prev[op.Instance]; !ok {
+			prev[op.Instance] = predecessor(op)
+		}
+		if dropped[i] {
+			continue
+		}
+		setPrevious(&op, prev[op.Instance])
+		prev[op.Instance] = op.Sequence
+		kept[op.Instance] = true
+		collapsed = append(collapsed, op)
+	}
+
+	for instance, seq := range prev {
+		if _, known := last[instance]; !known && !kept[instance] {
+			last[instance] = seq
+		}
+	}
+	return collapsed
+}
+
+// chain sets Previous on the operations of batch so each follows on
+// from the last operation sent for its instance.
+func chain(batch []protocol.PatchOperation, last map[string]int) {
+	prev := make(map[string]int)
+	for i := range batch {
+		op := &batch[i]
+		p, ok := prev[op.Instance]
+		if !ok {
+			p, ok = last[op.Instance]
+		}
+		if ok {
+			setPrevious(op, p)
+		}
+		prev[op.Instance] = op.Sequence
+	}
+}
+
+// predecessor returns the sequence number op follows on from.
+func predecessor(op protocol.PatchOperation) int {
+	if op.Previous != 0 {
+		return op.Previous
+	}
+	return op.Sequence - 1
+}
+
+func setPrevious(op *protocol.PatchOperation, prev int) {
+	if prev == op.Sequence-1 {
+		op.Previous = 0
+	} else {
+		op.Previous = prev
+	}
+}
@@ -0,0 +1,640 @@
+package outbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"thirdlight.com/protocol"
+)
+
+// spillFile is the name of the file, in the spill directory,
+// that holds operations which don't fit in memory.
+const spillFile = "outbox.jsonl"
+
+const (
+	defaultMaxBatch    = 100
+	defaultMaxInMemory = 10000
+	defaultMinBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+	defaultHistory     = 1000
+)
+
+// ErrClosed is returned when pushing to an outbox that has been closed.
+var ErrClosed = errors.New("outbox closed")
+
+// Options configures an Outbox.
+type Options struct {
+	// Dir is the directory operations are spilled to once more than
+	// MaxInMemory are pending, and where pending operations are kept
+	// across restarts. When empty, operations are only held in memory,
+	// and once MaxInMemory are pending those not yet being sent are
+	// dropped, and their instances resynced.
+	//
+	// Operations held in memory are only written to Dir by Close, so a
+	// crash loses them. That is safe as long as the instances are
+	// started in a new epoch by the next run, as the aggregator then
+	// fetches their files afresh.
+	Dir         string
+	MaxInMemory int
+	// MinBackoff and MaxBackoff bound the delay between retries.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Window is how long to wait for further operations to join
+	// a batch, unless MaxBatch operations are already waiting.
+	Window time.Duration
+	// MaxBatch is the most operations sent in a single request.
+	MaxBatch int
+	// History is how many delivered operations are kept to be sent
+	// again should the aggregator report it missed some.
+	History int
+	// Resync is called when the aggregator doesn't know an instance, has
+	// missed operations for it that are no longer held, or has refused
+	// them, so it needs to fetch the instance's files afresh.
+	Resync func(instance string)
+}
+
+// rejection is implemented by errors from send that say the aggregator
+// refused a batch, such as for being malformed, rather than failed to
+// handle it. Sending the batch again would only be refused again.
+type rejection interface {
+	Rejected() bool
+}
+
+// Outbox holds operations until they have been delivered, retrying
+// failed deliveries with exponential backoff and jitter. Operations
+// are delivered in batches, in the order they were pushed, and
+// operations made redundant by later ones are dropped before sending.
+type Outbox struct {
+	send    func([]protocol.PatchOperation) (protocol.PatchResponse, error)
+	options Options
+
+	mutex   sync.Mutex
+	pending []protocol.PatchOperation
+	// attempted counts the operations at the front of pending that were
+	// part of a failed delivery. The aggregator may have applied them,
+	// so they are not collapsed.
+	attempted int
+	// sending counts the operations at the front of pending in the
+	// delivery under way, which stay there until it completes.
+	sending int
+	// dropped holds the instances whose operations were dropped for
+	// want of room, which are resynced instead.
+	dropped map[string]bool
+	// last holds the sequence number of the last operation the
+	// aggregator has been sent for each instance.
+	last map[string]int
+	// epochs holds the epoch each instance started in, so that spilled
+	// operations from earlier runs can be told apart.
+	epochs map[string]int
+	// history holds the most recently delivered operations, oldest first.
+	history []protocol.PatchOperation
+	// spilled counts operations held in the spill file that
+	// haven't yet been read back, starting at spillOffset.
+	spilled     int
+	spillOffset int64
+	closed      bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns an outbox that delivers operations with send. Any
+// operations left in the spill directory by a previous run are queued
+// for delivery first.
+//
+// Batches that send fails to deliver are retried, unless the error has
+// a Rejected method returning true, as when the aggregator refuses the
+// batch outright. The batch is then dropped, and the instances it held
+// operations for are resynced.
+func New(send func([]protocol.PatchOperation) (protocol.PatchResponse, error), options Options) (*Outbox, error) {
+	if options.MaxInMemory <= 0 {
+		options.MaxInMemory = defaultMaxInMemory
+	}
+	if options.MaxBatch <= 0 {
+		options.MaxBatch = defaultMaxBatch
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaultMinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.History < 0 {
+		options.History = 0
+	} else if options.History == 0 {
+		options.History = defaultHistory
+	}
+	o := &Outbox{
+		send:    send,
+		options: options,
+		pending: make([]protocol.PatchOperation, 0),
+		last:    make(map[string]int),
+		epochs:  make(map[string]int),
+		dropped: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if options.Dir != "" {
+		if err := os.MkdirAll(options.Dir, 0755); err != nil {
+			return nil, err
+		}
+		count, err := o.countSpilled()
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			log.Printf("[INFO] Resuming delivery of %d operations from %s", count, o.spillPath())
+		}
+		o.spilled = count
+	}
+	return o, nil
+}
+
+// Push queues an operation for delivery.
+func (o *Outbox) Push(op protocol.PatchOperation) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return ErrClosed
+	}
+
+	// Once anything has been spilled, later operations must follow
+	// it to the spill file to keep them in order.
+	if o.options.Dir != "" && (o.spilled > 0 || len(o.pending) >= o.options.MaxInMemory) {
+		if err := o.appendSpill([]protocol.PatchOperation{op}); err != nil {
+			return err
+		}
+		o.spilled++
+	} else if o.options.Dir == "" && len(o.pending) >= o.options.MaxInMemory {
+		o.drop(op)
+	} else {
+		o.pending = append(o.pending, op)
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start records the epoch instance is running in, and the sequence
+// number the aggregator can be expected to have reached for it before
+// any operation is delivered. Operations for instance left in the spill
+// directory by an earlier epoch are dropped rather than delivered: the
+// aggregator fetches the files of an instance that has restarted, which
+// supersedes them, and their sequence numbers come before seqno.
+func (o *Outbox) Start(instance string, epoch, seqno int) {
+	o.mutex.Lock()
+	o.last[instance] = seqno
+	o.epochs[instance] = epoch
+	o.mutex.Unlock()
+}
+
+// Delivered returns the sequence number of the last operation
+// delivered for instance, if it is known.
+func (o *Outbox) Delivered(instance string) (int, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	seqno, ok := o.last[instance]
+	return seqno, ok
+}
+
+// Len returns the number of operations waiting to be delivered.
+func (o *Outbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.pending) + o.spilled
+}
+
+// Run delivers operations until the outbox is closed.
+func (o *Outbox) Run() {
+	defer close(o.done)
+	backoff := o.options.MinBackoff
+	retrying := false
+	for {
+		if o.options.Resync != nil {
+			for _, instance := range o.takeDropped() {
+				o.options.Resync(instance)
+			}
+		}
+		batch, err := o.next()
+		if err != nil {
+			log.Println("[ERROR] reading outbox:", err)
+		}
+		if len(batch) == 0 {
+			select {
+			case <-o.wake:
+				continue
+			case <-o.stop:
+				return
+			}
+		}
+		if !retrying && o.options.Window > 0 && len(batch) < o.options.MaxBatch {
+			if !o.gather() {
+				return
+			}
+			if batch, err = o.next(); err != nil {
+				log.Println("[ERROR] reading outbox:", err)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		response, err := o.send(batch)
+		if r, ok := err.(rejection); ok && r.Rejected() {
+			log.Printf("[ERROR] aggregator refused %d operations, dropping them: %v", len(batch), err)
+			retrying = false
+			backoff = o.options.MinBackoff
+			for _, instance := range o.reject(batch) {
+				if o.options.Resync != nil {
+					o.options.Resync(instance)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			o.fail(len(batch))
+			retrying = true
+			delay := jitter(backoff)
+			log.Printf("[ERROR] delivering %d operations, retrying in %s: %v", len(batch), delay, err)
+			select {
+			case <-time.After(delay):
+			case <-o.stop:
+				return
+			}
+			if backoff *= 2; backoff > o.options.MaxBackoff {
+				backoff = o.options.MaxBackoff
+			}
+			continue
+		}
+		retrying = false
+		backoff = o.options.MinBackoff
+		for _, instance := range o.ack(batch, response) {
+			if o.options.Resync != nil {
+				o.options.Resync(instance)
+			}
+		}
+	}
+}
+
+// gather waits for the batching window to pass, or for a full batch of
+// operations to be pending. It returns false if the outbox is closed.
+func (o *Outbox) gather() bool {
+	timer := time.NewTimer(o.options.Window)
+	defer timer.Stop()
+	for o.Len() < o.options.MaxBatch {
+		select {
+		case <-o.wake:
+		case <-timer.C:
+			return true
+		case <-o.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// Flush waits up to timeout for all pending operations to be delivered,
+// returning false if some remain.
+func (o *Outbox) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for o.Len() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// Close stops delivery. When a spill directory is configured, the
+// operations still pending are saved there to be delivered by the
+// next run.
+func (o *Outbox) Close() error {
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return nil
+	}
+	o.closed = true
+	o.mutex.Unlock()
+
+	close(o.stop)
+	<-o.done
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.options.Dir == "" || (len(o.pending) == 0 && o.spillOffset == 0) {
+		return nil
+	}
+	return o.saveAll()
+}
+
+// next returns the operations to send next, reading spilled
+// operations back into memory once those in memory are sent.
+func (o *Outbox) next() ([]protocol.PatchOperation, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.pending) == 0 && o.spilled > 0 {
+		if err := o.readSpill(); err != nil {
+			return nil, err
+		}
+	}
+
+	tail := collapse(o.pending[o.attempted:], o.last)
+	o.pending = o.pending[:o.attempted+len(tail)]
+
+	n := len(o.pending)
+	if n > o.options.MaxBatch {
+		n = o.options.MaxBatch
+	}
+	batch := make([]protocol.PatchOperation, n)
+	copy(batch, o.pending[:n])
+	chain(batch, o.last)
+	o.sending = n
+	return batch, nil
+}
+
+func (o *Outbox) fail(n int) {
+	o.mutex.Lock()
+	o.attempted = n
+	o.sending = 0
+	o.mutex.Unlock()
+}
+
+// drop discards op, and the pending operations that aren't being sent,
+// when there is no room left to hold it. Later operations follow on from
+// those dropped, and the aggregator fetches the files of their instances
+// afresh instead.
+func (o *Outbox) drop(op protocol.PatchOperation) {
+	keep := o.attempted
+	if o.sending > keep {
+		keep = o.sending
+	}
+	log.Printf("[ERROR] outbox is full, dropping %d operations and resyncing", len(o.pending)-keep+1)
+	for _, op := range append(o.pending[keep:], op) {
+		o.last[op.Instance] = op.Sequence
+		o.dropped[op.Instance] = true
+	}
+	o.pending = o.pending[:keep]
+}
+
+// takeDropped returns the instances whose operations have been dropped
+// since it was last called.
+func (o *Outbox) takeDropped() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	instances := make([]string, 0, len(o.dropped))
+	for instance := range o.dropped {
+		instances = append(instances, instance)
+	}
+	o.dropped = make(map[string]bool)
+	return instances
+}
+
+// ack removes a delivered batch from the outbox. Should the aggregator
+// report it is missing operations that came before some of the batch,
+// the delivered operations it lacks are queued to be sent again when
+// they are still held. The instances the aggregator needs to resync,
+// because it lacks operations that aren't held or doesn't know the
+// instance at all, are returned.
+func (o *Outbox) ack(batch []protocol.PatchOperation, response protocol.PatchResponse) []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.pending = o.pending[len(batch):]
+	o.attempted = 0
+	o.sending = 0
+	for _, op := range batch {
+		// Operations dropped while the batch was being sent have
+		// moved on the last sequence number already.
+		if op.Sequence > o.last[op.Instance] {
+			o.last[op.Instance] = op.Sequence
+		}
+	}
+	o.history = append(o.history, batch...)
+	if n := len(o.history) - o.options.History; n > 0 {
+		o.history = append(o.history[:0:0], o.history[n:]...)
+	}
+
+	missed := make(map[string]bool)
+	unknown := make(map[string]bool)
+	resync := make([]string, 0)
+	for _, result := range response.Results {
+		switch result.Status {
+		case protocol.StatusOutOfSequence:
+			missed[result.Instance] = true
+		case protocol.StatusUnknownNode:
+			if !unknown[result.Instance] {
+				log.Printf("[INFO] Aggregator doesn't know %s, registering again", result.Instance)
+				unknown[result.Instance] = true
+				resync = append(resync, result.Instance)
+			}
+		}
+	}
+	for _, node := range response.Nodes {
+		if !missed[node.Instance] {
+			continue
+		}
+		if !o.retransmit(node.Instance, node.Sequence) {
+			log.Printf("[INFO] Aggregator missed operations for %s, asking it to resync", node.Instance)
+			resync = append(resync, node.Instance)
+		}
+	}
+	return resync
+}
+
+// reject removes a batch the aggregator refused from the outbox, as if
+// it had been delivered, returning the instances it held operations
+// for, which the aggregator must fetch afresh.
+func (o *Outbox) reject(batch []protocol.PatchOperation) []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.pending = o.pending[len(batch):]
+	o.attempted = 0
+	o.sending = 0
+	seen := make(map[string]bool)
+	resync := make([]string, 0)
+	for _, op := range batch {
+		if op.Sequence > o.last[op.Instance] {
+			o.last[op.Instance] = op.Sequence
+		}
+		if !seen[op.Instance] {
+			seen[op.Instance] = true
+			resync = append(resync, op.Instance)
+		}
+	}
+	return resync
+}
+
+// retransmit queues the delivered operations of instance that follow
+// seqno to be sent again, returning false if they aren't all held.
+func (o *Outbox) retransmit(instance string, seqno int) bool {
+	missing := make([]protocol.PatchOperation, 0)
+	kept := o.history[:0:0]
+	for _, op := range o.history {
+		if op.Instance == instance && op.Sequence > seqno {
+			missing = append(missing, op)
+		} else {
+			kept = append(kept, op)
+		}
+	}
+	if len(missing) == 0 || predecessor(missing[0]) != seqno {
+		return false
+	}
+	log.Printf("[INFO] Sending %d operations for %s again from seqno %d", len(missing), instance, seqno)
+	o.history = kept
+	o.pending = append(missing, o.pending...)
+	o.last[instance] = seqno
+	return true
+}
+
+func (o *Outbox) spillPath() string {
+	return filepath.Join(o.options.Dir, spillFile)
+}
+
+func (o *Outbox) appendSpill(ops []protocol.PatchOperation) error {
+	f, err := os.OpenFile(o.spillPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, op := range ops {
+		if err := encoder.Encode(op); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readSpill moves up to MaxInMemory operations from the spill file
+// into memory, removing the file once it has been read completely.
+func (o *Outbox) readSpill() error {
+	f, err := os.Open(o.spillPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(o.spillOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	limit := o.options.MaxInMemory
+	if limit < o.options.MaxBatch {
+		limit = o.options.MaxBatch
+	}
+	reader := bufio.NewReader(f)
+	stale := 0
+	for o.spilled > 0 && len(o.pending) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			log.Printf("[ERROR] outbox spill file ended early, %d operations lost", o.spilled)
+			o.spilled = 0
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		o.spillOffset += int64(len(line))
+		o.spilled--
+
+		var op protocol.PatchOperation
+		if err := json.Unmarshal(line, &op); err != nil {
+			log.Println("[ERROR] skipping unreadable outbox entry:", err)
+			continue
+		}
+		if epoch, ok := o.epochs[op.Instance]; ok && op.Epoch < epoch {
+			stale++
+			continue
+		}
+		o.pending = append(o.pending, op)
+	}
+	if stale > 0 {
+		log.Printf("[INFO] Dropped %d operations from before their instances restarted", stale)
+	}
+
+	if o.spilled == 0 {
+		o.spillOffset = 0
+		return os.Remove(o.spillPath())
+	}
+	return nil
+}
+
+func (o *Outbox) countSpilled() (int, error) {
+	f, err := os.Open(o.spillPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// saveAll rewrites the spill file so it holds every pending
+// operation, those in memory first.
+func (o *Outbox) saveAll() error {
+	tmp, err := ioutil.TempFile(o.options.Dir, spillFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	encoder := json.NewEncoder(tmp)
+	for _, op := range o.pending {
+		if err := encoder.Encode(op); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if o.spilled > 0 {
+		f, err := os.Open(o.spillPath())
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, err = f.Seek(o.spillOffset, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(tmp, f)
+		}
+		f.Close()
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.spillPath())
+}
+
+// jitter returns a random duration between half and all of d,
+// so that nodes retrying together spread out.
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
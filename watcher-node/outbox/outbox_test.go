@@ -0,0 +1,474 @@
+package outbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"thirdlight.com/protocol"
+)
+
+// recorder is a send function that fails a set number
+// of times before recording what it is sent.
+type recorder struct {
+	mutex    sync.Mutex
+	failures int
+	sent     []int
+}
+
+func (r *recorder) send(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return protocol.PatchResponse{}, errors.New("aggregator unavailable")
+	}
+	for _, op := range ops {
+		r.sent = append(r.sent, op.Sequence)
+	}
+	return protocol.PatchResponse{}, nil
+}
+
+func (r *recorder) sequence() []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]int{}, r.sent...)
+}
+
+func TestRetryInOrder(t *testing.T) {
+	rec := &recorder{failures: 2}
+	o, err := New(rec.send, Options{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		o.Push(protocol.PatchOperation{Op: "add", Sequence: i})
+	}
+	go o.Run()
+	defer o.Close()
+
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	if expected := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(rec.sequence(), expected) {
+		t.Errorf("expected: %v, got: %v", expected, rec.sequence())
+	}
+}
+
+func TestSpillAcrossRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	failing := &recorder{failures: 1 << 30}
+	o, err := New(failing.send, Options{Dir: dir, MaxInMemory: 2, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	for i := 1; i <= 5; i++ {
+		if err := o.Push(protocol.PatchOperation{Op: "add", Sequence: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.Len() != 5 {
+		t.Errorf("expected 5 pending operations, got %d", o.Len())
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recorder{}
+	o, err = New(rec.send, Options{Dir: dir, MaxInMemory: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	if expected := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(rec.sequence(), expected) {
+		t.Errorf("expected: %v, got: %v", expected, rec.sequence())
+	}
+	if _, err := os.Stat(o.spillPath()); !os.IsNotExist(err) {
+		t.Error("expected spill file to be removed once drained")
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	op := func(seq int, kind, filename string) protocol.PatchOperation {
+		return protocol.PatchOperation{
+			BaseMessage: protocol.BaseMessage{Instance: "node"},
+			Op:          kind,
+			Value:       protocol.FileMetadata{Filename: filename, Size: int64(seq)},
+			Sequence:    seq,
+		}
+	}
+	ops := []protocol.PatchOperation{
+		op(2, "add", "partial.tmp"),
+		op(3, "add", "cat.jpg"),
+		op(4, "modify", "partial.tmp"),
+		op(5, "modify", "cat.jpg"),
+		op(6, "remove", "partial.tmp"),
+		op(7, "remove", "dog.jpg"),
+	}
+
+	last := make(map[string]int)
+	collapsed := collapse(ops, last)
+
+	if len(collapsed) != 2 {
+		t.Fatalf("expected 2 operations, got %d: %+v", len(collapsed), collapsed)
+	}
+	if c := collapsed[0]; c.Sequence != 3 || c.Op != "add" || c.Value.Size != 5 || c.Previous != 1 {
+		t.Errorf("expected add of cat.jpg with modified value following 1, got %+v", c)
+	}
+	if c := collapsed[1]; c.Sequence != 7 || c.Op != "remove" || c.Previous != 3 {
+		t.Errorf("expected remove of dog.jpg following 3, got %+v", c)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	var mutex sync.Mutex
+	batches := make([][]protocol.PatchOperation, 0)
+	send := func(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+		mutex.Lock()
+		batches = append(batches, ops)
+		mutex.Unlock()
+		return protocol.PatchResponse{}, nil
+	}
+
+	o, err := New(send, Options{Window: 50 * time.Millisecond, MaxBatch: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Run()
+	defer o.Close()
+	for i := 1; i <= 4; i++ {
+		o.Push(protocol.PatchOperation{Op: "add", Sequence: i, Value: protocol.FileMetadata{Filename: string(rune('a' + i))}})
+	}
+
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 {
+		t.Errorf("expected batches of 3 and 1 operations, got %v", batches)
+	}
+}
+
+// sequencer is a send function that applies operations in sequence
+// and reports the results as the aggregator does.
+type sequencer struct {
+	mutex sync.Mutex
+	seqno int
+}
+
+func (s *sequencer) send(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := protocol.PatchResponse{}
+	for _, op := range ops {
+		status := protocol.StatusApplied
+		if predecessor(op) != s.seqno {
+			status = protocol.StatusOutOfSequence
+		} else {
+			s.seqno = op.Sequence
+		}
+		response.Results = append(response.Results, protocol.PatchResult{Instance: op.Instance, Sequence: op.Sequence, Status: status})
+	}
+	response.Nodes = []protocol.NodeSequence{{BaseMessage: protocol.BaseMessage{Instance: "node"}, Sequence: s.seqno}}
+	return response, nil
+}
+
+// forget makes the aggregator lose the operations it has applied.
+func (s *sequencer) forget() {
+	s.mutex.Lock()
+	s.seqno = 0
+	s.mutex.Unlock()
+}
+
+func (s *sequencer) sequence() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.seqno
+}
+
+func TestMissedOperations(t *testing.T) {
+	tests := []struct {
+		name    string
+		history int
+		seqno   int
+		resyncs int
+	}{
+		{"retransmit", 0, 5, 0},
+		{"resync", -1, 0, 1},
+	}
+	for _, test := range tests {
+		agg := &sequencer{}
+		var mutex sync.Mutex
+		resyncs := 0
+		o, err := New(agg.send, Options{
+			History: test.history,
+			Resync: func(instance string) {
+				mutex.Lock()
+				resyncs++
+				mutex.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go o.Run()
+
+		push := func(from, to int) {
+			for i := from; i <= to; i++ {
+				o.Push(protocol.PatchOperation{BaseMessage: protocol.BaseMessage{Instance: "node"}, Op: "add", Sequence: i})
+			}
+			if !o.Flush(time.Second) {
+				t.Fatalf("%s: outbox not drained, %d operations pending", test.name, o.Len())
+			}
+		}
+		push(1, 3)
+		agg.forget()
+		push(4, 5)
+		o.Close()
+
+		if agg.sequence() != test.seqno {
+			t.Errorf("%s: expected aggregator at %d, got %d", test.name, test.seqno, agg.sequence())
+		}
+		mutex.Lock()
+		if resyncs != test.resyncs {
+			t.Errorf("%s: expected %d resyncs, got %d", test.name, test.resyncs, resyncs)
+		}
+		mutex.Unlock()
+	}
+}
+
+func TestUnknownNode(t *testing.T) {
+	send := func(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+		response := protocol.PatchResponse{}
+		for _, op := range ops {
+			response.Results = append(response.Results, protocol.PatchResult{Instance: op.Instance, Sequence: op.Sequence, Status: protocol.StatusUnknownNode})
+		}
+		return response, nil
+	}
+	resynced := make(chan string, 10)
+	o, err := New(send, Options{Resync: func(instance string) { resynced <- instance }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		o.Push(protocol.PatchOperation{BaseMessage: protocol.BaseMessage{Instance: "node"}, Op: "add", Sequence: i})
+	}
+	go o.Run()
+	defer o.Close()
+
+	select {
+	case instance := <-resynced:
+		if instance != "node" {
+			t.Errorf("expected resync of node, got %s", instance)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected unknown node to be resynced")
+	}
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	if len(resynced) != 0 {
+		t.Errorf("expected a single resync, got %d more", len(resynced))
+	}
+}
+
+// validator is a send function that refuses batches holding invalid
+// operations, as the aggregator does, and records those it accepts.
+type validator struct {
+	recorder
+	refused int
+}
+
+type refusal struct{ error }
+
+func (refusal) Rejected() bool { return true }
+
+func (v *validator) send(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+	for _, op := range ops {
+		if err := op.Validate(); err != nil {
+			v.mutex.Lock()
+			v.refused++
+			v.mutex.Unlock()
+			return protocol.PatchResponse{}, refusal{err}
+		}
+	}
+	return v.recorder.send(ops)
+}
+
+func (v *validator) refusals() int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.refused
+}
+
+// TestRestartWithSpill checks that operations spilled by an earlier run
+// of an instance are dropped once it restarts in a later epoch, rather
+// than chained on from its resumed sequence number.
+func TestRestartWithSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	op := func(epoch, seq int) protocol.PatchOperation {
+		return protocol.PatchOperation{
+			BaseMessage: protocol.BaseMessage{Instance: "3f0e4bc6-30f0-4a0c-8d3e-9a2e9e6a2c51", Epoch: epoch},
+			Op:          "add",
+			Value:       protocol.FileMetadata{Filename: string(rune('a' + seq))},
+			Sequence:    seq,
+		}
+	}
+
+	failing := &recorder{failures: 1 << 30}
+	o, err := New(failing.send, Options{Dir: dir, MaxInMemory: 2, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Start(op(1, 0).Instance, 1, 0)
+	go o.Run()
+	for i := 1; i <= 5; i++ {
+		if err := o.Push(op(1, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	agg := &validator{}
+	o, err = New(agg.send, Options{Dir: dir, MaxInMemory: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Start(op(2, 0).Instance, 2, 6)
+	for i := 7; i <= 8; i++ {
+		if err := o.Push(op(2, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go o.Run()
+	defer o.Close()
+
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	if expected := []int{7, 8}; !reflect.DeepEqual(agg.sequence(), expected) {
+		t.Errorf("expected: %v, got: %v", expected, agg.sequence())
+	}
+	if agg.refusals() != 0 {
+		t.Errorf("expected no batches to be refused, got %d", agg.refusals())
+	}
+}
+
+// TestRejected checks that a batch the aggregator refuses is dropped and
+// its instance resynced, rather than retried ahead of later operations.
+func TestRejected(t *testing.T) {
+	agg := &validator{}
+	resynced := make(chan string, 10)
+	o, err := New(agg.send, Options{MinBackoff: time.Hour, Resync: func(instance string) { resynced <- instance }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := protocol.BaseMessage{Instance: "3f0e4bc6-30f0-4a0c-8d3e-9a2e9e6a2c51", Epoch: 1}
+	o.Push(protocol.PatchOperation{BaseMessage: base, Op: "rename", Value: protocol.FileMetadata{Filename: "a"}, Sequence: 1})
+	go o.Run()
+	defer o.Close()
+
+	select {
+	case instance := <-resynced:
+		if instance != base.Instance {
+			t.Errorf("expected resync of %s, got %s", base.Instance, instance)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected refused instance to be resynced")
+	}
+	o.Push(protocol.PatchOperation{BaseMessage: base, Op: "add", Value: protocol.FileMetadata{Filename: "b"}, Sequence: 2})
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	if expected := []int{2}; !reflect.DeepEqual(agg.sequence(), expected) {
+		t.Errorf("expected: %v, got: %v", expected, agg.sequence())
+	}
+}
+
+// TestFullInMemory checks that without a spill directory, operations
+// beyond MaxInMemory are dropped, other than those being sent, and the
+// instance resynced, with later operations following on from them.
+func TestFullInMemory(t *testing.T) {
+	agg := &sequencer{}
+	sending, release := make(chan struct{}), make(chan struct{})
+	send := func(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+		if ops[0].Sequence == 1 {
+			close(sending)
+			<-release
+		}
+		return agg.send(ops)
+	}
+	resynced := make(chan string, 10)
+	o, err := New(send, Options{
+		MaxInMemory: 3,
+		Resync: func(instance string) {
+			// The aggregator fetches the node's files, as of the
+			// operations dropped.
+			agg.mutex.Lock()
+			agg.seqno = 4
+			agg.mutex.Unlock()
+			resynced <- instance
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(i int) {
+		if err := o.Push(protocol.PatchOperation{BaseMessage: protocol.BaseMessage{Instance: "node"}, Op: "add", Sequence: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push(1)
+	go o.Run()
+	defer o.Close()
+	<-sending
+
+	for i := 2; i <= 4; i++ {
+		push(i)
+	}
+	if o.Len() != 1 {
+		t.Errorf("expected only the operation being sent to be held, got %d", o.Len())
+	}
+	close(release)
+	push(5)
+
+	select {
+	case instance := <-resynced:
+		if instance != "node" {
+			t.Errorf("expected resync of node, got %s", instance)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected instance with dropped operations to be resynced")
+	}
+	if !o.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", o.Len())
+	}
+	if agg.sequence() != 5 {
+		t.Errorf("expected aggregator at 5, got %d", agg.sequence())
+	}
+	if len(resynced) != 0 {
+		t.Errorf("expected a single resync, got %d more", len(resynced))
+	}
+}
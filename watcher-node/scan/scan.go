@@ -0,0 +1,137 @@
+package scan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"thirdlight.com/watcher-node/filestore"
+)
+
+// Describe returns the store metadata for the entry at path. Regular files
+// are hashed with SHA-256; other entries only carry their size.
+func Describe(path string) (filestore.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return filestore.File{}, err
+	}
+	return describe(path, info)
+}
+
+func describe(path string, info os.FileInfo) (filestore.File, error) {
+	file := filestore.File{Size: info.Size(), Dir: info.IsDir()}
+	if !info.Mode().IsRegular() {
+		return file, nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return filestore.File{}, err
+	}
+	file.Hash = hash
+	return file, nil
+}
+
+// Dir describes every entry in directory that allow accepts, or every entry
+// when allow is nil. Entries that disappear or cannot be read while
+// scanning are left out.
+func Dir(directory string, allow func(name string, isDir bool) bool) (map[string]filestore.File, error) {
+	return NewScanner(directory, allow).Scan()
+}
+
+// Scanner describes a directory repeatedly, reusing the hash of any file
+// whose size and modification time are unchanged since the previous scan.
+// A Scanner is not safe for concurrent use.
+type Scanner struct {
+	directory string
+	allow     func(name string, isDir bool) bool
+	seen      map[string]seenFile
+}
+
+type seenFile struct {
+	modTime time.Time
+	file    filestore.File
+}
+
+// NewScanner returns a Scanner for the entries of directory that
+// allow accepts, or every entry when allow is nil.
+func NewScanner(directory string, allow func(name string, isDir bool) bool) *Scanner {
+	return &Scanner{
+		directory: directory,
+		allow:     allow,
+		seen:      make(map[string]seenFile),
+	}
+}
+
+// Scan describes the current contents of the directory. Entries that
+// disappear or cannot be read while scanning are left out.
+func (s *Scanner) Scan() (map[string]filestore.File, error) {
+	entries, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]filestore.File, len(entries))
+	seen := make(map[string]seenFile, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if s.allow != nil && !s.allow(name, entry.IsDir()) {
+			continue
+		}
+		path := filepath.Join(s.directory, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		file, err := s.describe(name, path, info)
+		if err != nil {
+			continue
+		}
+		files[name] = file
+		seen[name] = seenFile{modTime: info.ModTime(), file: file}
+	}
+	s.seen = seen
+	return files, nil
+}
+
+// Describe returns the store metadata for the entry called name in the
+// directory, reusing its hash from the last scan or description if its
+// size and modification time are unchanged.
+func (s *Scanner) Describe(name string) (filestore.File, error) {
+	path := filepath.Join(s.directory, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return filestore.File{}, err
+	}
+	file, err := s.describe(name, path, info)
+	if err != nil {
+		return filestore.File{}, err
+	}
+	s.seen[name] = seenFile{modTime: info.ModTime(), file: file}
+	return file, nil
+}
+
+func (s *Scanner) describe(name, path string, info os.FileInfo) (filestore.File, error) {
+	if prev, ok := s.seen[name]; ok && prev.file.Size == info.Size() && prev.modTime.Equal(info.ModTime()) {
+		return prev.file, nil
+	}
+	return describe(path, info)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,80 @@
+package scan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestScannerCache checks that a file is only hashed again once its size
+// or modification time changes, and that entries allow refuses are left
+// out.
+func TestScannerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.txt")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(contents string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "skip.tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := NewScanner(dir, func(name string, isDir bool) bool {
+		return filepath.Ext(name) != ".tmp"
+	})
+	write("first", modTime)
+	files, err := scanner.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected file.txt and sub, got %v", files)
+	}
+	if sub := files["sub"]; !sub.Dir || sub.Hash != "" {
+		t.Errorf("expected sub to be an unhashed directory, got %+v", sub)
+	}
+	first := files["file.txt"]
+	if first.Size != 5 || first.Hash == "" {
+		t.Fatalf("expected file.txt to be hashed, got %+v", first)
+	}
+
+	// The same size and modification time are taken to mean the file is
+	// unchanged, so its hash isn't recomputed.
+	write("other", modTime)
+	if files, _ := scanner.Scan(); files["file.txt"] != first {
+		t.Errorf("expected cached %+v, got %+v", first, files["file.txt"])
+	}
+	if described, err := scanner.Describe("file.txt"); err != nil || described != first {
+		t.Errorf("expected cached %+v, got %+v, %v", first, described, err)
+	}
+
+	write("other", modTime.Add(time.Second))
+	files, _ = scanner.Scan()
+	second := files["file.txt"]
+	if second.Hash == first.Hash {
+		t.Error("expected a file with a new modification time to be hashed again")
+	}
+	if described, err := Describe(path); err != nil || described != second {
+		t.Errorf("expected %+v, got %+v, %v", second, described, err)
+	}
+
+	write("longer", modTime.Add(time.Second))
+	if files, _ := scanner.Scan(); files["file.txt"].Size != 6 || files["file.txt"].Hash == second.Hash {
+		t.Errorf("expected a file with a new size to be hashed again, got %+v", files["file.txt"])
+	}
+}
@@ -2,14 +2,21 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"thirdlight.com/protocol"
 	"thirdlight.com/watcher-node/filestore"
-	"thirdlight.com/watcher-node/lib"
 )
 
-func FilesHandler(store *filestore.Store) http.HandlerFunc {
+// FilesHandler lists the files of one of the stores. The store is chosen by
+// the instance or label query parameters, defaulting to the first store.
+func FilesHandler(stores []*filestore.Store) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !(r.Method == http.MethodGet) {
 			log.Println("[ERROR] invalid request method :", r.Method)
@@ -17,19 +24,178 @@ func FilesHandler(store *filestore.Store) http.HandlerFunc {
 			return
 		}
 
+		store := selectStore(stores, r)
+		if store == nil {
+			http.Error(w, "unknown instance", http.StatusNotFound)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 
-		filesMeta := []lib.FileMetadata{}
-		list, seqNo := store.GetList()
-		for name, _ := range list {
-			filesMeta = append(filesMeta, lib.FileMetadata{
+		snapshot := store.Snapshot()
+		filesMeta := make([]protocol.FileMetadata, 0, snapshot.Len())
+		snapshot.Each(func(name string, file filestore.File) {
+			filesMeta = append(filesMeta, protocol.FileMetadata{
 				Filename: name,
+				Size:     file.Size,
+				Hash:     file.Hash,
 			})
+		})
+		json.NewEncoder(w).Encode(protocol.ListResponse{
+			Files:    filesMeta,
+			Sequence: snapshot.Sequence(),
+			Label:    store.Label(),
+			BaseMessage: protocol.BaseMessage{
+				Instance: store.Instance(),
+				Epoch:    store.Epoch(),
+			},
+		})
+	})
+}
+
+// ChangesHandler lists the changes made to one of the stores since the
+// sequence number in the since query parameter, choosing the store as
+// FilesHandler does. It responds gone when the store no longer holds
+// all the changes, so the full list must be fetched instead.
+func ChangesHandler(stores []*filestore.Store) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !(r.Method == http.MethodGet) {
+			log.Println("[ERROR] invalid request method :", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-		json.NewEncoder(w).Encode(lib.ListResponse{
-			Files:       filesMeta,
+
+		since, err := strconv.Atoi(r.URL.Query().Get("since"))
+		if err != nil {
+			http.Error(w, "since must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		store := selectStore(stores, r)
+		if store == nil {
+			http.Error(w, "unknown instance", http.StatusNotFound)
+			return
+		}
+		changes, seqNo, ok := store.ChangesSince(since)
+		if !ok {
+			http.Error(w, "changes no longer held", http.StatusGone)
+			return
+		}
+
+		base := protocol.BaseMessage{
+			Instance: store.Instance(),
+			Epoch:    store.Epoch(),
+		}
+		operations := make([]protocol.PatchOperation, 0, len(changes))
+		for _, change := range changes {
+			operations = append(operations, protocol.PatchOperation{
+				BaseMessage: base,
+				Op:          change.Op,
+				Value: protocol.FileMetadata{
+					Filename: change.Filename,
+					Size:     change.File.Size,
+					Hash:     change.File.Hash,
+				},
+				Sequence: change.Sequence,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(protocol.ChangesResponse{
+			BaseMessage: base,
+			Label:       store.Label(),
+			Operations:  operations,
 			Sequence:    seqNo,
-			BaseMessage: lib.BaseMessage{store.Instance()},
 		})
 	})
 }
+
+// ErrSubscribeRefused is returned by a subscribe callback when the node
+// already pushes its changes to an aggregator it was configured with.
+var ErrSubscribeRefused = errors.New("node already pushes to its configured aggregator")
+
+// SubscribeHandler handles requests from an aggregator polling the node
+// for it to push changes as well, calling subscribe with the address of
+// the aggregator. Requests must be signed with secret, or made by a peer
+// presenting a certificate for aggregatorName that the node's certificate
+// authority signed.
+func SubscribeHandler(secret []byte, aggregatorName string, subscribe func(aggregator string) error) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !(r.Method == http.MethodPost) {
+			log.Println("[ERROR] invalid request method :", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request", http.StatusBadRequest)
+			return
+		}
+		if err := authenticate(secret, aggregatorName, r, body); err != nil {
+			log.Println("[ERROR] refusing subscription from", r.RemoteAddr+":", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var request protocol.SubscribeRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+			return
+		}
+		if err := request.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := subscribe(request.Aggregator); err != nil {
+			log.Println("[ERROR]", err)
+			status := http.StatusBadRequest
+			if err == ErrSubscribeRefused {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// authenticate returns an error unless a request was made by the
+// aggregator called name, as its verified certificate shows, or signed
+// with secret recently. A verified certificate alone isn't enough, as the
+// same authorities sign the certificates of nodes.
+func authenticate(secret []byte, name string, r *http.Request, body []byte) error {
+	if cert := protocol.PeerCertificate(r.TLS); cert != nil && name != "" && protocol.CertifiesName(cert, name) {
+		return nil
+	}
+	if secret == nil {
+		if name == "" {
+			return errors.New("subscriptions aren't accepted")
+		}
+		return fmt.Errorf("a verified client certificate for %s is required", name)
+	}
+	signature, err := protocol.SignatureFromHeader(r.Header)
+	if err != nil {
+		return err
+	}
+	if err := signature.CheckTime(time.Now(), protocol.DefaultSignatureWindow); err != nil {
+		return err
+	}
+	return signature.Verify(secret, r.Method, r.URL.Path, body)
+}
+
+func selectStore(stores []*filestore.Store, r *http.Request) *filestore.Store {
+	query := r.URL.Query()
+	instance, label := query.Get("instance"), query.Get("label")
+	if instance == "" && label == "" {
+		if len(stores) == 0 {
+			return nil
+		}
+		return stores[0]
+	}
+	for _, store := range stores {
+		if (instance == "" || store.Instance() == instance) &&
+			(label == "" || store.Label() == label) {
+			return store
+		}
+	}
+	return nil
+}
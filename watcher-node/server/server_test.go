@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"thirdlight.com/protocol"
+	"thirdlight.com/watcher-node/filestore"
+)
+
+// TestFilesDuringUpdates checks, under the race detector, that file
+// lists served while the store changes match their sequence number.
+func TestFilesDuringUpdates(t *testing.T) {
+	store := filestore.New("test")
+	handler := FilesHandler([]*filestore.Store{store})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			store.Update("add", fmt.Sprintf("file-%d", i), filestore.File{})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/files", nil))
+		var response protocol.ListResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Files) != response.Sequence {
+			t.Fatalf("listing at %d holds %d files", response.Sequence, len(response.Files))
+		}
+	}
+	wg.Wait()
+}
+
+// TestSubscribe checks that only signed requests, or those made with the
+// configured aggregator's certificate, may subscribe an aggregator, and
+// that a node with an aggregator configured refuses them.
+func TestSubscribe(t *testing.T) {
+	secret := []byte("secret")
+	var subscribed string
+	refuse := false
+	handler := SubscribeHandler(secret, "aggregator", func(aggregator string) error {
+		if refuse {
+			return ErrSubscribeRefused
+		}
+		subscribed = aggregator
+		return nil
+	})
+	body := []byte(`{"aggregator":"http://aggregator:8000"}`)
+	request := func(secret []byte, name string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/subscribe", bytes.NewReader(body))
+		if name != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		if secret != nil {
+			signature, err := protocol.Sign(secret, r.Method, r.URL.Path, body, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature.SetHeader(r.Header)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		secret   []byte
+		cert     string
+		refuse   bool
+		expected int
+	}{
+		{"unsigned", nil, "", false, http.StatusUnauthorized},
+		{"signed with another secret", []byte("other"), "", false, http.StatusUnauthorized},
+		{"signed", secret, "", false, http.StatusOK},
+		{"signed with an aggregator configured", secret, "", true, http.StatusConflict},
+		{"aggregator's certificate", nil, "aggregator", false, http.StatusOK},
+		{"another certificate", nil, "node", false, http.StatusUnauthorized},
+		{"another certificate, signed", secret, "node", false, http.StatusOK},
+	}
+	for _, test := range tests {
+		subscribed, refuse = "", test.refuse
+		recorder := httptest.NewRecorder()
+		handler(recorder, request(test.secret, test.cert))
+		if recorder.Code != test.expected {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expected, recorder.Code)
+		}
+		if (subscribed != "") != (test.expected == http.StatusOK) {
+			t.Errorf("%s: subscribed %q", test.name, subscribed)
+		}
+	}
+}
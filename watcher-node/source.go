@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"thirdlight.com/protocol"
+	"thirdlight.com/watcher-node/filestore"
+	"thirdlight.com/watcher-node/filter"
+	"thirdlight.com/watcher-node/outbox"
+	"thirdlight.com/watcher-node/scan"
+	"thirdlight.com/watcher-node/state"
+)
+
+// reserveBlock is how far ahead of the sequence numbers in use the
+// saved sequence number is kept, so the state file needn't be written
+// for every change.
+const reserveBlock = 1000
+
+// modifyDelay is how long a file must go unwritten before a change to
+// it is reported. A file being written produces a stream of writes, and
+// it would otherwise be hashed again for each.
+const modifyDelay = 500 * time.Millisecond
+
+// source is a single watched directory. Each source has its own
+// store, and so its own instance and sequence numbers, and is
+// reported to the aggregator as a separate node.
+type source struct {
+	directory string
+	store     *filestore.Store
+	filter    *filter.Filter
+	scanner   *scan.Scanner
+	// polled is set when the directory is scanned periodically
+	// rather than watched for filesystem notifications.
+	polled bool
+	state  *state.Store
+	// reserved is the sequence number saved in the state file. It
+	// is always at least the highest sequence number used, so a
+	// restart after a crash never reuses one.
+	reserved int
+	// modified holds the time of the latest write to each file
+	// written since it was last described.
+	modified map[string]time.Time
+}
+
+// parseDirs turns the values of the -dir flag into directory paths keyed
+// by label. Each value may be a comma separated list, and each entry
+// may be given as label=path; the label defaults to the directory name.
+// A directory may only be given once, as its state is kept by path.
+func parseDirs(values []string) (map[string]string, []string, error) {
+	dirs := make(map[string]string)
+	labels := make([]string, 0)
+	watched := make(map[string]string)
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			label, dir := "", entry
+			if i := strings.Index(entry, "="); i >= 0 {
+				label, dir = entry[:i], entry[i+1:]
+			}
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				return nil, nil, err
+			}
+			if label == "" {
+				label = filepath.Base(abs)
+			}
+			if _, exists := dirs[label]; exists {
+				return nil, nil, fmt.Errorf("label %q is used by more than one directory", label)
+			}
+			if other, exists := watched[abs]; exists {
+				return nil, nil, fmt.Errorf("directory %s is given as both %q and %q", abs, other, label)
+			}
+			watched[abs] = label
+			dirs[label] = abs
+			labels = append(labels, label)
+		}
+	}
+	return dirs, labels, nil
+}
+
+func newSource(label, directory string, includes, excludes []string, st *state.Store) (*source, error) {
+	fileFilter, err := filter.New(includes, excludes)
+	if err != nil {
+		return nil, err
+	}
+	if err := fileFilter.Load(directory); err != nil {
+		return nil, err
+	}
+
+	scanner := scan.NewScanner(directory, fileFilter.Allow)
+	store, err := initializeStoreForDirectory(label, directory, scanner, st)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{
+		directory: directory,
+		store:     store,
+		filter:    fileFilter,
+		scanner:   scanner,
+		state:     st,
+		modified:  make(map[string]time.Time),
+	}
+	if err := src.reserve(store.Sequence()); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// initializeStoreForDirectory returns a store holding the contents of the
+// directory, resuming the instance saved for it by an earlier run if any.
+func initializeStoreForDirectory(
+	label string,
+	directory string,
+	scanner *scan.Scanner,
+	st *state.Store,
+) (*filestore.Store, error) {
+	store := filestore.New(label)
+	saved, ok, err := st.Load(directory)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		store = filestore.Resume(label, saved.Instance, saved.Sequence, saved.Epoch)
+		log.Printf("[INFO] Resuming instance %s for %s in epoch %d", saved.Instance, directory, store.Epoch())
+	} else {
+		log.Printf("[INFO] Starting instance %s for %s", store.Instance(), directory)
+	}
+
+	files, err := scanner.Scan()
+	if err != nil {
+		return nil, err
+	}
+
+	store.AddFiles(files)
+	return store, nil
+}
+
+// reserve saves a sequence number a block ahead of seqno.
+func (s *source) reserve(seqno int) error {
+	if err := s.state.Save(s.directory, state.Source{
+		Instance: s.store.Instance(),
+		Sequence: seqno + reserveBlock,
+		Epoch:    s.store.Epoch(),
+	}); err != nil {
+		return err
+	}
+	s.reserved = seqno + reserveBlock
+	return nil
+}
+
+// saveState saves the exact sequence number reached, so the next run
+// continues from it. It must only be called once the source has
+// stopped handling changes.
+func (s *source) saveState() error {
+	return s.state.Save(s.directory, state.Source{
+		Instance: s.store.Instance(),
+		Sequence: s.store.Sequence(),
+		Epoch:    s.store.Epoch(),
+	})
+}
+
+func (s *source) handleEvent(event fsnotify.Event, out *outbox.Outbox) {
+	op := getOp(event)
+	if op == "" {
+		return
+	}
+	filename := filepath.Base(event.Name)
+
+	if filename == filter.IgnoreFile {
+		// The rules have changed, so entries may need to be
+		// added or removed to match them.
+		log.Println("[INFO] Reloading", event.Name)
+		if err := s.reconcile(out); err != nil {
+			log.Println("[ERROR]: ", err)
+		}
+	}
+
+	if op == remove {
+		delete(s.modified, filename)
+		if _, ok := s.store.Get(filename); ok {
+			s.notify(remove, filename, filestore.File{}, out)
+		}
+		return
+	}
+	if op == modify {
+		if _, ok := s.store.Get(filename); ok {
+			s.modified[filename] = time.Now()
+			return
+		}
+	}
+	s.update(filename, out)
+}
+
+// settle reports changes to the files that have gone unwritten for
+// modifyDelay by now.
+func (s *source) settle(now time.Time, out *outbox.Outbox) {
+	for filename, written := range s.modified {
+		if now.Sub(written) >= modifyDelay {
+			delete(s.modified, filename)
+			s.update(filename, out)
+		}
+	}
+}
+
+// update describes a file and reports it as added or modified, if it
+// differs from the store.
+func (s *source) update(filename string, out *outbox.Outbox) {
+	file, err := s.scanner.Describe(filename)
+	if err != nil {
+		// The entry has already gone again, its removal event will follow.
+		log.Println("[ERROR]: ", err)
+		return
+	}
+	if !s.filter.Allow(filename, file.Dir) {
+		return
+	}
+	if current, ok := s.store.Get(filename); ok {
+		if current == file {
+			return
+		}
+		s.notify(modify, filename, file, out)
+		return
+	}
+	s.notify(add, filename, file, out)
+}
+
+// reconcile reloads the ignore rules and brings the store in line with the
+// current contents of the directory, queueing an operation for the
+// aggregator for each difference.
+func (s *source) reconcile(out *outbox.Outbox) error {
+	if err := s.filter.Load(s.directory); err != nil {
+		return err
+	}
+	files, err := s.scanner.Scan()
+	if err != nil {
+		return err
+	}
+
+	current := s.store.Snapshot()
+	current.Each(func(name string, _ filestore.File) {
+		if _, ok := files[name]; !ok {
+			s.notify(remove, name, filestore.File{}, out)
+		}
+	})
+	for name, file := range files {
+		if existing, ok := current.Get(name); !ok {
+			s.notify(add, name, file, out)
+		} else if existing != file {
+			s.notify(modify, name, file, out)
+		}
+	}
+	return nil
+}
+
+// notify applies an operation to the store and queues it for delivery
+// to the aggregator.
+func (s *source) notify(
+	op string,
+	filename string,
+	file filestore.File,
+	out *outbox.Outbox,
+) {
+	opSeqNo := s.store.Update(op, filename, file)
+	if opSeqNo >= s.reserved {
+		if err := s.reserve(opSeqNo); err != nil {
+			log.Println("[ERROR]: ", err)
+		}
+	}
+
+	err := out.Push(protocol.PatchOperation{
+		BaseMessage: protocol.BaseMessage{
+			Instance: s.store.Instance(),
+			Epoch:    s.store.Epoch(),
+		},
+		Op: op,
+		Value: protocol.FileMetadata{
+			Filename: filename,
+			Size:     file.Size,
+			Hash:     file.Hash,
+		},
+		Sequence: opSeqNo,
+	})
+	if err != nil {
+		log.Println("[ERROR]: ", err)
+	}
+}
+
+// getOp returns the operation an event makes on a file. Events may
+// combine several, such as Create|Write, so the most significant is taken.
+func getOp(event fsnotify.Event) string {
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		return add
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		return remove
+	case event.Op&fsnotify.Write != 0:
+		return modify
+	}
+	return ""
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"thirdlight.com/protocol"
+	"thirdlight.com/watcher-node/filestore"
+	"thirdlight.com/watcher-node/outbox"
+	"thirdlight.com/watcher-node/state"
+)
+
+func TestGetOp(t *testing.T) {
+	tests := []struct {
+		op       fsnotify.Op
+		expected string
+	}{
+		{fsnotify.Create, add},
+		{fsnotify.Create | fsnotify.Write, add},
+		{fsnotify.Write, modify},
+		{fsnotify.Write | fsnotify.Chmod, modify},
+		{fsnotify.Remove, remove},
+		{fsnotify.Rename | fsnotify.Chmod, remove},
+		{fsnotify.Chmod, ""},
+	}
+	for _, test := range tests {
+		if op := getOp(fsnotify.Event{Name: "file.txt", Op: test.op}); op != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.op, test.expected, op)
+		}
+	}
+}
+
+// TestParseDirs checks that directories are read from repeated and comma
+// separated -dir values, labelled by name or as given, and that neither a
+// label nor a directory may be used twice.
+func TestParseDirs(t *testing.T) {
+	abs := func(path string) string {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return abs
+	}
+	tests := []struct {
+		values []string
+		dirs   map[string]string
+		labels []string
+	}{
+		{[]string{"./photos"}, map[string]string{"photos": abs("photos")}, []string{"photos"}},
+		{[]string{"pics=./photos"}, map[string]string{"pics": abs("photos")}, []string{"pics"}},
+		{[]string{"./photos", "docs=/srv/documents"}, map[string]string{"photos": abs("photos"), "docs": "/srv/documents"}, []string{"photos", "docs"}},
+		{[]string{"a/photos, docs=b/docs,", " c/music"}, map[string]string{"photos": abs("a/photos"), "docs": abs("b/docs"), "music": abs("c/music")}, []string{"photos", "docs", "music"}},
+		{[]string{"=./photos"}, map[string]string{"photos": abs("photos")}, []string{"photos"}},
+		{[]string{"photos=./photos", "pictures=./photos"}, nil, nil},
+		{[]string{"./photos,photos=photos/"}, nil, nil},
+		{[]string{"a/photos", "b/photos"}, nil, nil},
+		{[]string{"docs=a", "docs=b"}, nil, nil},
+	}
+	for _, test := range tests {
+		dirs, labels, err := parseDirs(test.values)
+		if test.dirs == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.values, dirs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(dirs, test.dirs) || !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("%q: expected %v in order %v, got %v in order %v", test.values, test.dirs, test.labels, dirs, labels)
+		}
+	}
+}
+
+// TestResume checks that a directory keeps its instance across runs, each
+// in a later epoch, and that after a crash its sequence numbers carry on
+// past any the crashed run may have used.
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	watched := filepath.Join(dir, "watched")
+	if err := os.Mkdir(watched, 0755); err != nil {
+		t.Fatal(err)
+	}
+	st, err := state.Open(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := outbox.New(func([]protocol.PatchOperation) (protocol.PatchResponse, error) {
+		return protocol.PatchResponse{}, nil
+	}, outbox.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := newSource("watched", watched, nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.store.Epoch() != 1 {
+		t.Errorf("expected a new instance to start in epoch 1, got %d", first.store.Epoch())
+	}
+	// Use more sequence numbers than are reserved at once, so the
+	// reservation must have been moved on.
+	for i := 0; i <= reserveBlock; i++ {
+		first.notify(add, fmt.Sprintf("file-%d", i), filestore.File{}, out)
+	}
+	used := first.store.Sequence()
+
+	// The node crashes, without saving the sequence number reached.
+	second, err := newSource("watched", watched, nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.store.Instance() != first.store.Instance() {
+		t.Errorf("expected instance %s to be resumed, got %s", first.store.Instance(), second.store.Instance())
+	}
+	if second.store.Epoch() != 2 {
+		t.Errorf("expected the resumed instance to be in epoch 2, got %d", second.store.Epoch())
+	}
+	if second.store.Sequence() <= used {
+		t.Errorf("expected sequence numbers to carry on past %d after a crash, got %d", used, second.store.Sequence())
+	}
+
+	// Stopped cleanly, the next run carries on from the exact sequence
+	// number reached.
+	second.notify(add, "another", filestore.File{}, out)
+	if err := second.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	third, err := newSource("watched", watched, nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.store.Epoch() != 3 {
+		t.Errorf("expected the resumed instance to be in epoch 3, got %d", third.store.Epoch())
+	}
+	// Starting up scans the directory as one further change.
+	if third.store.Sequence() != second.store.Sequence()+1 {
+		t.Errorf("expected sequence numbers to carry on from %d, got %d", second.store.Sequence(), third.store.Sequence())
+	}
+}
+
+// TestReconcile checks that rescanning a directory queues an add, modify
+// or remove for each entry that differs from the store, and nothing for
+// those that don't or are excluded.
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("kept.txt", "kept")
+	write("changed.txt", "before")
+	write("removed.txt", "removed")
+
+	st, err := state.Open(filepath.Join(dir, ".state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSource("test", dir, nil, []string{"*.tmp", ".state"}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mutex sync.Mutex
+		sent  = make(map[string]protocol.PatchOperation)
+	)
+	out, err := outbox.New(func(ops []protocol.PatchOperation) (protocol.PatchResponse, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, op := range ops {
+			sent[op.Value.Filename] = op
+		}
+		return protocol.PatchResponse{}, nil
+	}, outbox.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go out.Run()
+	defer out.Close()
+
+	write("changed.txt", "after, and longer")
+	write("added.txt", "added")
+	write("ignored.tmp", "ignored")
+	if err := os.Remove(filepath.Join(dir, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.reconcile(out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Flush(time.Second) {
+		t.Fatalf("outbox not drained, %d operations pending", out.Len())
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := map[string]string{"changed.txt": modify, "added.txt": add, "removed.txt": remove}
+	if len(sent) != len(expected) {
+		t.Errorf("expected operations for %v, got %v", expected, sent)
+	}
+	for name, op := range expected {
+		if sent[name].Op != op {
+			t.Errorf("%s: expected %q, got %+v", name, op, sent[name])
+		}
+	}
+	if changed := sent["changed.txt"].Value; changed.Size != 17 || changed.Hash == "" {
+		t.Errorf("expected the new size and hash of changed.txt, got %+v", changed)
+	}
+	files := src.store.Snapshot()
+	if _, ok := files.Get("removed.txt"); ok {
+		t.Error("expected removed.txt to be removed from the store")
+	}
+	if file, ok := files.Get("added.txt"); !ok || file.Size != 5 {
+		t.Errorf("expected added.txt in the store, got %+v", file)
+	}
+}
+
+// TestSettle checks that writes to a file are only reported once they
+// have stopped for modifyDelay, as a single modification.
+func TestSettle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "growing.txt")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := state.Open(filepath.Join(dir, ".state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSource("test", dir, nil, []string{".state"}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := outbox.New(func([]protocol.PatchOperation) (protocol.PatchResponse, error) {
+		return protocol.PatchResponse{}, nil
+	}, outbox.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := src.store.Sequence()
+
+	for i := 1; i <= 5; i++ {
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), i), 0644); err != nil {
+			t.Fatal(err)
+		}
+		src.handleEvent(fsnotify.Event{Name: path, Op: fsnotify.Write}, out)
+	}
+	src.settle(time.Now(), out)
+	if src.store.Sequence() != start {
+		t.Errorf("expected no change while the file is being written, got %d", src.store.Sequence()-start)
+	}
+
+	src.settle(time.Now().Add(modifyDelay), out)
+	if src.store.Sequence() != start+1 {
+		t.Errorf("expected a single change once writes stop, got %d", src.store.Sequence()-start)
+	}
+	if file, _ := src.store.Get("growing.txt"); file.Size != 5 {
+		t.Errorf("expected the file's final size, got %+v", file)
+	}
+	src.settle(time.Now().Add(2*modifyDelay), out)
+	if src.store.Sequence() != start+1 {
+		t.Errorf("expected a settled file not to be reported again, got %d changes", src.store.Sequence()-start)
+	}
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Source is the state kept for a single watched directory.
+type Source struct {
+	Directory string `json:"directory"`
+	Instance  string `json:"instance"`
+	// Sequence is at least the highest sequence number the
+	// directory's instance has used.
+	Sequence int `json:"seqno"`
+	// Epoch is the number of the latest run of the instance.
+	Epoch int `json:"epoch"`
+}
+
+// Store keeps the state of each watched directory in its own file
+// within a state directory, so that watcher nodes watching different
+// directories can share one.
+type Store struct {
+	dir string
+}
+
+// Open returns a store keeping state files in dir, creating
+// it if need be.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Load returns the state saved for directory, if any.
+func (s *Store) Load(directory string) (Source, bool, error) {
+	data, err := ioutil.ReadFile(s.path(directory))
+	if os.IsNotExist(err) {
+		return Source{}, false, nil
+	}
+	if err != nil {
+		return Source{}, false, err
+	}
+
+	var src Source
+	if err := json.Unmarshal(data, &src); err != nil {
+		return Source{}, false, err
+	}
+	return src, src.Instance != "", nil
+}
+
+// Save writes the state of directory.
+func (s *Store) Save(directory string, src Source) error {
+	src.Directory = directory
+	data, err := json.MarshalIndent(src, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it over the state
+	// file so a crash can't leave it half written.
+	path := s.path(directory)
+	tmp, err := ioutil.TempFile(s.dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path returns the state file for directory, named after
+// a hash of its path.
+func (s *Store) path(directory string) string {
+	sum := sha1.Sum([]byte(directory))
+	return filepath.Join(s.dir, "watcher-node-"+hex.EncodeToString(sum[:8])+".state.json")
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSaveLoad checks that the state saved for each directory is loaded
+// back for it alone.
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(filepath.Join(dir, "nested", "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := store.Load("/photos"); err != nil || ok {
+		t.Fatalf("expected no state before saving, got %v, %v", ok, err)
+	}
+
+	photos := Source{Instance: "56d1a8de-14a8-403b-b3e7-d49307c63553", Sequence: 1012, Epoch: 3}
+	docs := Source{Instance: "2f0d3d7e-5a44-4a8b-9b0c-1f8e8b9a7c11", Sequence: 4, Epoch: 1}
+	if err := store.Save("/photos", photos); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save("/docs", docs); err != nil {
+		t.Fatal(err)
+	}
+	photos.Directory, docs.Directory = "/photos", "/docs"
+
+	// A store opened afresh, as on the next run, finds the same state.
+	store, err = Open(filepath.Join(dir, "nested", "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []Source{photos, docs} {
+		loaded, ok, err := store.Load(expected.Directory)
+		if err != nil || !ok {
+			t.Fatalf("%s: expected saved state, got %v, %v", expected.Directory, ok, err)
+		}
+		if loaded != expected {
+			t.Errorf("%s: expected %+v, got %+v", expected.Directory, expected, loaded)
+		}
+	}
+
+	photos.Sequence = 2012
+	if err := store.Save("/photos", photos); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _, _ := store.Load("/photos"); loaded != photos {
+		t.Errorf("expected saving again to replace the state, got %+v", loaded)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "nested", "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected a state file for each directory and nothing else, got %d files", len(files))
+	}
+}